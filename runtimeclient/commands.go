@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/MarcosDY/npipeSample/server/cri"
+)
+
+// Labels set by the kubelet on the containers it creates
+const (
+	labelPodName      = "io.kubernetes.pod.name"
+	labelPodNamespace = "io.kubernetes.pod.namespace"
+)
+
+// containerView is the output of a container
+type containerView struct {
+	ID           string `json:"id" yaml:"id"`
+	Name         string `json:"name" yaml:"name"`
+	PID          uint32 `json:"pid" yaml:"pid"`
+	State        string `json:"state" yaml:"state"`
+	Image        string `json:"image" yaml:"image"`
+	RuntimeType  string `json:"runtimeType" yaml:"runtimeType"`
+	PodSandboxID string `json:"podSandboxId" yaml:"podSandboxId"`
+	PodName      string `json:"podName,omitempty" yaml:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty" yaml:"podNamespace,omitempty"`
+
+	Isolation       string               `json:"isolation,omitempty" yaml:"isolation,omitempty"`
+	HostProcess     bool                 `json:"hostProcess" yaml:"hostProcess"`
+	NamedPipes      []string             `json:"namedPipes,omitempty" yaml:"namedPipes,omitempty"`
+	SecurityContext *securityContextView `json:"securityContext,omitempty" yaml:"securityContext,omitempty"`
+}
+
+// securityContextView is the output of a container security context
+type securityContextView struct {
+	RunAsUsername  string `json:"runAsUsername,omitempty" yaml:"runAsUsername,omitempty"`
+	RunAsUser      *int64 `json:"runAsUser,omitempty" yaml:"runAsUser,omitempty"`
+	RunAsGroup     *int64 `json:"runAsGroup,omitempty" yaml:"runAsGroup,omitempty"`
+	Privileged     bool   `json:"privileged" yaml:"privileged"`
+	ReadonlyRootfs bool   `json:"readonlyRootfs" yaml:"readonlyRootfs"`
+	GMSA           bool   `json:"gmsa" yaml:"gmsa"`
+}
+
+// podSandboxView is the output of a pod sandbox
+type podSandboxView struct {
+	ID             string            `json:"id" yaml:"id"`
+	Name           string            `json:"name" yaml:"name"`
+	Namespace      string            `json:"namespace" yaml:"namespace"`
+	UID            string            `json:"uid" yaml:"uid"`
+	RuntimeHandler string            `json:"runtimeHandler" yaml:"runtimeHandler"`
+	Labels         map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// inspectView is the output of lookup and inspect
+type inspectView struct {
+	Container  containerView   `json:"container" yaml:"container"`
+	PodSandbox *podSandboxView `json:"podSandbox,omitempty" yaml:"podSandbox,omitempty"`
+}
+
+// selectorsView is the output of selectors
+type selectorsView struct {
+	PID         int32    `json:"pid" yaml:"pid"`
+	ContainerID string   `json:"containerId" yaml:"containerId"`
+	Selectors   []string `json:"selectors" yaml:"selectors"`
+}
+
+func runLookup(ctx context.Context, e *env, _ []string) error {
+	container, err := e.resolver.ContainerByPID(ctx, e.pID)
+	if err != nil {
+		return err
+	}
+	return inspect(ctx, e, container)
+}
+
+func runInspect(ctx context.Context, e *env, args []string) error {
+	container, err := e.resolver.ContainerByID(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return inspect(ctx, e, container)
+}
+
+func inspect(ctx context.Context, e *env, container *cri.Container) error {
+	view := inspectView{
+		Container: newContainerView(container),
+	}
+	sandbox, err := e.resolver.PodSandboxByID(ctx, container.PodSandboxID)
+	if err != nil {
+		return err
+	}
+	view.PodSandbox = &podSandboxView{
+		ID:             sandbox.ID,
+		Name:           sandbox.Name,
+		Namespace:      sandbox.Namespace,
+		UID:            sandbox.UID,
+		RuntimeHandler: sandbox.RuntimeHandler,
+		Labels:         sandbox.Labels,
+	}
+
+	return write(e.out, e.output, view, func(tw *tabwriter.Writer) {
+		c, p := view.Container, view.PodSandbox
+		fmt.Fprintf(tw, "Container ID:\t%s\n", c.ID)
+		fmt.Fprintf(tw, "Name:\t%s\n", c.Name)
+		fmt.Fprintf(tw, "PID:\t%d\n", c.PID)
+		fmt.Fprintf(tw, "State:\t%s\n", c.State)
+		fmt.Fprintf(tw, "Image:\t%s\n", c.Image)
+		fmt.Fprintf(tw, "Runtime type:\t%s\n", c.RuntimeType)
+		fmt.Fprintf(tw, "Isolation:\t%s\n", c.Isolation)
+		fmt.Fprintf(tw, "HostProcess:\t%t\n", c.HostProcess)
+		for _, pipe := range c.NamedPipes {
+			fmt.Fprintf(tw, "Named pipe:\t%s\n", pipe)
+		}
+		if sc := c.SecurityContext; sc != nil {
+			fmt.Fprintf(tw, "Run as user:\t%s\n", runAsUser(sc))
+			fmt.Fprintf(tw, "Privileged:\t%t\n", sc.Privileged)
+		}
+		fmt.Fprintf(tw, "Pod sandbox ID:\t%s\n", p.ID)
+		fmt.Fprintf(tw, "Pod:\t%s/%s\n", p.Namespace, p.Name)
+		fmt.Fprintf(tw, "Pod UID:\t%s\n", p.UID)
+		fmt.Fprintf(tw, "Runtime handler:\t%s\n", p.RuntimeHandler)
+	})
+}
+
+func runList(ctx context.Context, e *env, _ []string) error {
+	containers, err := e.resolver.ListContainers(ctx)
+	if err != nil {
+		return err
+	}
+
+	views := make([]containerView, 0, len(containers))
+	for _, container := range containers {
+		views = append(views, newContainerView(container))
+	}
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].PodNamespace != views[j].PodNamespace {
+			return views[i].PodNamespace < views[j].PodNamespace
+		}
+		if views[i].PodName != views[j].PodName {
+			return views[i].PodName < views[j].PodName
+		}
+		return views[i].Name < views[j].Name
+	})
+
+	return write(e.out, e.output, views, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "CONTAINER ID\tNAME\tPID\tSTATE\tPOD\tNAMESPACE\tRUNTIME TYPE")
+		for _, c := range views {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortID(c.ID), c.Name, pidString(c.PID), c.State, c.PodName, c.PodNamespace, c.RuntimeType)
+		}
+	})
+}
+
+func runSelectors(ctx context.Context, e *env, _ []string) error {
+	container, err := e.resolver.ContainerByPID(ctx, e.pID)
+	if err != nil {
+		return err
+	}
+	selectors, _, err := e.pods.PodByContainer(ctx, container.ID, "")
+	if err != nil {
+		return err
+	}
+	sort.Strings(selectors)
+
+	view := selectorsView{
+		PID:         e.pID,
+		ContainerID: container.ID,
+		Selectors:   selectors,
+	}
+	return write(e.out, e.output, view, func(tw *tabwriter.Writer) {
+		for _, selector := range selectors {
+			fmt.Fprintln(tw, selector)
+		}
+	})
+}
+
+func newContainerView(c *cri.Container) containerView {
+	view := containerView{
+		ID:           c.ID,
+		Name:         c.Name,
+		PID:          c.PID,
+		State:        c.State,
+		Image:        c.Image,
+		RuntimeType:  c.RuntimeType,
+		PodSandboxID: c.PodSandboxID,
+		PodName:      c.Labels[labelPodName],
+		PodNamespace: c.Labels[labelPodNamespace],
+		Isolation:    string(c.Isolation),
+		HostProcess:  c.HostProcess,
+		NamedPipes:   c.NamedPipes,
+	}
+	if sc := c.SecurityContext; sc != nil {
+		view.SecurityContext = &securityContextView{
+			RunAsUsername:  sc.RunAsUsername,
+			RunAsUser:      sc.RunAsUser,
+			RunAsGroup:     sc.RunAsGroup,
+			Privileged:     sc.Privileged,
+			ReadonlyRootfs: sc.ReadonlyRootfs,
+			GMSA:           sc.GMSA,
+		}
+	}
+	return view
+}
+
+// runAsUser returns the user name, or the uid and gid of Linux containers
+func runAsUser(sc *securityContextView) string {
+	switch {
+	case sc.RunAsUsername != "":
+		return sc.RunAsUsername
+	case sc.RunAsUser != nil && sc.RunAsGroup != nil:
+		return fmt.Sprintf("%d:%d", *sc.RunAsUser, *sc.RunAsGroup)
+	case sc.RunAsUser != nil:
+		return strconv.FormatInt(*sc.RunAsUser, 10)
+	default:
+		return ""
+	}
+}
+
+// shortID truncates container IDs like docker and crictl do
+func shortID(id string) string {
+	if len(id) > 13 {
+		return id[:13]
+	}
+	return id
+}
+
+func pidString(pID uint32) string {
+	if pID == 0 {
+		return "-"
+	}
+	return strconv.FormatUint(uint64(pID), 10)
+}
@@ -1,73 +1,182 @@
+// Command runtimeclient looks up containers, pod sandboxes and selectors
+// through the CRI endpoint of the container runtime, for debugging on nodes.
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"os"
 	"time"
 
-	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
-	"k8s.io/kubernetes/pkg/kubelet/cri/remote"
+	"github.com/MarcosDY/npipeSample/server/cri"
+	"github.com/hashicorp/go-hclog"
 )
 
+// Exit codes
 const (
-	containerDPipe = "npipe:////./pipe/containerd-containerd"
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
 )
 
-var (
-	pID            = flag.Int("pid", 0, "")
-	defaultTimeout = 2 * time.Second
-)
+const defaultTimeout = 5 * time.Second
+
+// errUsage is returned for invalid arguments
+var errUsage = errors.New("invalid usage")
+
+// command is a subcommand of the CLI
+type command struct {
+	name  string
+	args  string
+	usage string
+	// needsPID registers the --pid flag, which is then required
+	needsPID bool
+	// positional is the number of positional arguments
+	positional int
+	run        func(ctx context.Context, e *env, args []string) error
+}
+
+// env holds the runtime clients and options of a command
+type env struct {
+	out      io.Writer
+	output   string
+	pID      int32
+	resolver cri.Resolver
+	pods     *cri.PodClient
+}
+
+var commands = []*command{
+	{name: "lookup", args: "--pid <pid>", usage: "show the container and pod sandbox of a process", needsPID: true, run: runLookup},
+	{name: "list", usage: "list the containers of the runtime", run: runList},
+	{name: "inspect", args: "<container-id>", usage: "show a container and its pod sandbox", positional: 1, run: runInspect},
+	{name: "selectors", args: "--pid <pid>", usage: "show the pod selectors of a process", needsPID: true, run: runSelectors},
+}
 
 func main() {
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
 
-	res, err := remote.NewRemoteRuntimeService(containerDPipe, defaultTimeout)
-	if err != nil {
-		log.Fatalf("failed to open connection: %v\n", err)
+func run(args []string, stdout, stderr io.Writer) int {
+	err := runCommand(args, stdout, stderr)
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	case errors.Is(err, cri.ErrContainerNotFound),
+		errors.Is(err, cri.ErrContainerIDNotFound),
+		errors.Is(err, cri.ErrPodSandboxNotFound),
+		errors.Is(err, cri.ErrNotKubernetesContainer):
+		fmt.Fprintln(stderr, err)
+		return exitNotFound
+	default:
+		fmt.Fprintln(stderr, err)
+		return exitError
 	}
+}
 
-	containers, err := res.ListContainers(&runtimeapi.ContainerFilter{})
-	if err != nil {
-		log.Fatalf("failed to get containers: %v\n", err)
+func runCommand(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		usage(stderr)
+		return fmt.Errorf("%w: no command", errUsage)
 	}
 
-	type ContainerInfo struct {
-		SandboxID   string `json:"sandboxID"`
-		Pid         uint32 `json:"pid"`
-		Removing    bool   `json:"removing"`
-		SnapshotKey string `json:"snapshotKey"`
-		Snapshotter string `json:"snapshotter"`
-		RuntimeType string `json:"runtimeType"`
-		// RuntimeOptions interface{} `json:"runtimeOptions"`
-		// Config         *runtime.ContainerConfig `json:"config"`
-		// RuntimeSpec    *runtimespec.Spec        `json:"runtimeSpec"`
+	var cmd *command
+	for _, each := range commands {
+		if each.name == args[0] {
+			cmd = each
+		}
+	}
+	if cmd == nil {
+		usage(stderr)
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
 	}
 
-	var containerID string
-	var podID string
-	for _, each := range containers {
-		stat, err := res.ContainerStatus(each.Id, true)
-		if err != nil {
-			log.Printf("failed to get contianer stats: %v\n", err)
-		}
-		infoStr := stat.Info["info"]
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	endpoint := fs.String("endpoint", "", "CRI endpoint (unix:// or npipe:// URL), empty detects a well-known endpoint")
+	output := fs.String("output", outputText, "output format: text, json or yaml")
+	timeout := fs.Duration("timeout", defaultTimeout, "timeout of the command")
+	nodeName := fs.String("node-name", os.Getenv("MY_NODE_NAME"), "node name used for the node-name selector")
+	var pID *int
+	if cmd.needsPID {
+		pID = fs.Int("pid", 0, "process ID")
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: runtimeclient %s %s [flags]\n\n%s.\n\nFlags:\n", cmd.name, cmd.args, cmd.usage)
+		fs.PrintDefaults()
+	}
 
-		containerInfo := ContainerInfo{}
+	positional, err := parseInterspersed(fs, args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return err
+	case err != nil:
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
 
-		if err := json.Unmarshal([]byte(infoStr), &containerInfo); err != nil {
-			log.Printf("failed to unmarshal info: %v\n", err)
-			continue
-		}
+	e := &env{
+		out:    stdout,
+		output: *output,
+	}
+	switch {
+	case len(positional) != cmd.positional:
+		return fmt.Errorf("%w: %s expects %d arguments, got %d", errUsage, cmd.name, cmd.positional, len(positional))
+	case !validOutput(*output):
+		return fmt.Errorf("%w: unknown output format %q", errUsage, *output)
+	case cmd.needsPID && *pID <= 0:
+		return fmt.Errorf("%w: %s requires --pid", errUsage, cmd.name)
+	case cmd.needsPID:
+		e.pID = int32(*pID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	criEndpoint, err := cri.ResolveEndpoint(*endpoint)
+	if err != nil {
+		return err
+	}
+	conn, err := cri.Dial(ctx, criEndpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-		if uint32(*pID) == containerInfo.Pid {
-			containerID = each.Id
-			podID = each.PodSandboxId
+	client := cri.NewRuntimeServiceClient(conn)
+	e.resolver = cri.NewResolver(hclog.NewNullLogger(), client)
+	e.pods = cri.NewPodClient(hclog.NewNullLogger(), client, *nodeName)
+
+	return cmd.run(ctx, e, positional)
+}
 
-			break
+// parseInterspersed parses the flags, allowing positional arguments before and
+// between them, and returns the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
 		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: runtimeclient <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.usage)
 	}
-	fmt.Println(containerID)
-	fmt.Println(podID)
+	fmt.Fprintf(w, "\nRun 'runtimeclient <command> -h' for the flags of a command.\n")
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	webID     = "a1b2c3d4e5f6"
+	webPID    = "4242"
+	sandboxID = "3f8e5a4c2b1d"
+	podUID    = "0c7a3f52-8f5e-4d38-9a8e-2f1b7c3d9e10"
+	// plainID is a container that was not created by the kubelet
+	plainID  = "b2c3d4e5f6a1"
+	plainPID = "5151"
+)
+
+// fakeRuntime serves a pod sandbox with a web container, and a container
+// without kubelet labels
+type fakeRuntime struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+}
+
+var (
+	fakeSandbox = &runtimeapi.PodSandbox{
+		Id:       sandboxID,
+		Metadata: &runtimeapi.PodSandboxMetadata{Name: "web-7c9f8d6b5-x2k4p", Namespace: "default", Uid: podUID},
+		State:    runtimeapi.PodSandboxState_SANDBOX_READY,
+		Labels: map[string]string{
+			"app":                         "web",
+			"io.kubernetes.pod.name":      "web-7c9f8d6b5-x2k4p",
+			"io.kubernetes.pod.namespace": "default",
+			"io.kubernetes.pod.uid":       podUID,
+		},
+		RuntimeHandler: "runhcs-wcow-process",
+	}
+
+	fakeContainers = []struct {
+		container *runtimeapi.Container
+		info      string
+	}{
+		{
+			container: &runtimeapi.Container{
+				Id:           webID,
+				PodSandboxId: sandboxID,
+				Metadata:     &runtimeapi.ContainerMetadata{Name: "web"},
+				Image:        &runtimeapi.ImageSpec{Image: "mcr.microsoft.com/windows/servercore:ltsc2022"},
+				State:        runtimeapi.ContainerState_CONTAINER_RUNNING,
+				Labels: map[string]string{
+					"io.kubernetes.container.name": "web",
+					"io.kubernetes.pod.name":       "web-7c9f8d6b5-x2k4p",
+					"io.kubernetes.pod.namespace":  "default",
+					"io.kubernetes.pod.uid":        podUID,
+				},
+			},
+			info: `{"pid": 4242, "runtimeType": "io.containerd.runhcs.v1", "config": {}, "runtimeSpec": {"windows": {}}}`,
+		},
+		{
+			container: &runtimeapi.Container{
+				Id:       plainID,
+				Metadata: &runtimeapi.ContainerMetadata{Name: "plain"},
+				Image:    &runtimeapi.ImageSpec{Image: "mcr.microsoft.com/windows/nanoserver:ltsc2022"},
+				State:    runtimeapi.ContainerState_CONTAINER_RUNNING,
+			},
+			info: `{"pid": 5151, "runtimeType": "io.containerd.runhcs.v1", "config": {}, "runtimeSpec": {"windows": {}}}`,
+		},
+	}
+)
+
+func (fakeRuntime) Version(context.Context, *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	return &runtimeapi.VersionResponse{RuntimeName: "containerd", RuntimeVersion: "v1.7.0"}, nil
+}
+
+func (fakeRuntime) ListContainers(_ context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	filter := req.GetFilter()
+	resp := new(runtimeapi.ListContainersResponse)
+	for _, each := range fakeContainers {
+		if filter.GetId() != "" && filter.GetId() != each.container.Id {
+			continue
+		}
+		if filter.GetPodSandboxId() != "" && filter.GetPodSandboxId() != each.container.PodSandboxId {
+			continue
+		}
+		resp.Containers = append(resp.Containers, each.container)
+	}
+	return resp, nil
+}
+
+func (fakeRuntime) ContainerStatus(_ context.Context, req *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	for _, each := range fakeContainers {
+		if each.container.Id != req.ContainerId {
+			continue
+		}
+		return &runtimeapi.ContainerStatusResponse{
+			Status: &runtimeapi.ContainerStatus{
+				Id:       each.container.Id,
+				Metadata: each.container.Metadata,
+				State:    each.container.State,
+				Image:    each.container.Image,
+				Labels:   each.container.Labels,
+			},
+			Info: map[string]string{"info": each.info},
+		}, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "container %q not found", req.ContainerId)
+}
+
+func (fakeRuntime) PodSandboxStatus(_ context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	if req.PodSandboxId != sandboxID {
+		return nil, status.Errorf(codes.NotFound, "pod sandbox %q not found", req.PodSandboxId)
+	}
+	return &runtimeapi.PodSandboxStatusResponse{
+		Status: &runtimeapi.PodSandboxStatus{
+			Id:             fakeSandbox.Id,
+			Metadata:       fakeSandbox.Metadata,
+			State:          fakeSandbox.State,
+			Labels:         fakeSandbox.Labels,
+			RuntimeHandler: fakeSandbox.RuntimeHandler,
+		},
+	}, nil
+}
+
+func (fakeRuntime) ListPodSandbox(_ context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	for key, value := range req.GetFilter().GetLabelSelector() {
+		if fakeSandbox.Labels[key] != value {
+			return new(runtimeapi.ListPodSandboxResponse), nil
+		}
+	}
+	return &runtimeapi.ListPodSandboxResponse{Items: []*runtimeapi.PodSandbox{fakeSandbox}}, nil
+}
+
+// serveFakeRuntime serves fakeRuntime on a Unix socket and returns its endpoint
+func serveFakeRuntime(t *testing.T) string {
+	t.Helper()
+
+	// Unix socket paths are short, t.TempDir includes the test name
+	dir, err := os.MkdirTemp("", "runtimeclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "cri.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(server, &fakeRuntime{})
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	return "unix://" + socketPath
+}
+
+func TestRun(t *testing.T) {
+	endpoint := serveFakeRuntime(t)
+	unreachable := "unix://" + filepath.Join(t.TempDir(), "missing.sock")
+
+	for _, tt := range []struct {
+		name     string
+		args     []string
+		exitCode int
+		// contains are expected in the standard output, or in the standard
+		// error when the command fails
+		contains []string
+		// check verifies the standard output
+		check func(t *testing.T, stdout []byte)
+	}{
+		{
+			name:     "no command",
+			exitCode: exitUsage,
+			contains: []string{"Usage: runtimeclient <command>"},
+		},
+		{
+			name:     "unknown command",
+			args:     []string{"delete"},
+			exitCode: exitUsage,
+			contains: []string{`unknown command "delete"`},
+		},
+		{
+			name:     "unknown flag",
+			args:     []string{"list", "--verbose"},
+			exitCode: exitUsage,
+			contains: []string{"flag provided but not defined: -verbose"},
+		},
+		{
+			name:     "unknown output",
+			args:     []string{"list", "--output", "xml"},
+			exitCode: exitUsage,
+			contains: []string{`unknown output format "xml"`},
+		},
+		{
+			name:     "missing PID",
+			args:     []string{"lookup"},
+			exitCode: exitUsage,
+			contains: []string{"lookup requires --pid"},
+		},
+		{
+			name:     "extra argument",
+			args:     []string{"inspect", webID, plainID},
+			exitCode: exitUsage,
+			contains: []string{"inspect expects 1 arguments, got 2"},
+		},
+		{
+			name:     "help",
+			args:     []string{"list", "-h"},
+			exitCode: exitOK,
+			contains: []string{"Usage: runtimeclient list"},
+		},
+		{
+			name:     "unreachable runtime",
+			args:     []string{"list", "--endpoint", unreachable, "--timeout", "100ms"},
+			exitCode: exitError,
+			contains: []string{"failed to connect to CRI endpoint"},
+		},
+		{
+			name:     "lookup",
+			args:     []string{"lookup", "--pid", webPID, "--endpoint", endpoint},
+			contains: []string{"Container ID:     " + webID, "Pod:              default/web-7c9f8d6b5-x2k4p"},
+		},
+		{
+			name:  "lookup json",
+			args:  []string{"lookup", "--pid", webPID, "--endpoint", endpoint, "--output", "json"},
+			check: checkInspect(json.Unmarshal),
+		},
+		{
+			name:  "lookup yaml",
+			args:  []string{"lookup", "--pid", webPID, "--endpoint", endpoint, "--output", "yaml"},
+			check: checkInspect(yaml.Unmarshal),
+		},
+		{
+			name:     "lookup not found",
+			args:     []string{"lookup", "--pid", "9999", "--endpoint", endpoint},
+			exitCode: exitNotFound,
+		},
+		{
+			name:     "list",
+			args:     []string{"list", "--endpoint", endpoint},
+			contains: []string{"CONTAINER ID", webID + "  web", plainID + "  plain"},
+		},
+		{
+			name:  "list json",
+			args:  []string{"list", "--endpoint", endpoint, "--output", "json"},
+			check: checkList(json.Unmarshal),
+		},
+		{
+			name:  "list yaml",
+			args:  []string{"list", "--endpoint", endpoint, "--output", "yaml"},
+			check: checkList(yaml.Unmarshal),
+		},
+		{
+			// Flags may follow the positional arguments
+			name:     "inspect",
+			args:     []string{"inspect", webID, "--endpoint", endpoint},
+			contains: []string{"Container ID:     " + webID, "Pod UID:          " + podUID},
+		},
+		{
+			name:  "inspect json",
+			args:  []string{"inspect", "--endpoint", endpoint, "--output", "json", webID},
+			check: checkInspect(json.Unmarshal),
+		},
+		{
+			name:  "inspect yaml",
+			args:  []string{"inspect", "--endpoint", endpoint, "--output", "yaml", webID},
+			check: checkInspect(yaml.Unmarshal),
+		},
+		{
+			name:     "inspect not found",
+			args:     []string{"inspect", "--endpoint", endpoint, "missing"},
+			exitCode: exitNotFound,
+		},
+		{
+			name:     "selectors",
+			args:     []string{"selectors", "--pid", webPID, "--endpoint", endpoint, "--node-name", "node1"},
+			contains: []string{"container-name:web\n", "node-name:node1\n", "pod-uid:" + podUID + "\n"},
+		},
+		{
+			name:  "selectors json",
+			args:  []string{"selectors", "--pid", webPID, "--endpoint", endpoint, "--node-name", "node1", "--output", "json"},
+			check: checkSelectors(json.Unmarshal),
+		},
+		{
+			name:  "selectors yaml",
+			args:  []string{"selectors", "--pid", webPID, "--endpoint", endpoint, "--node-name", "node1", "--output", "yaml"},
+			check: checkSelectors(yaml.Unmarshal),
+		},
+		{
+			name:     "selectors of a container without pod",
+			args:     []string{"selectors", "--pid", plainPID, "--endpoint", endpoint},
+			exitCode: exitNotFound,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := run(tt.args, &stdout, &stderr)
+			if exitCode != tt.exitCode {
+				t.Fatalf("unexpected exit code %d, want %d: %s", exitCode, tt.exitCode, stderr.String())
+			}
+
+			output := stdout.String()
+			if tt.exitCode != exitOK || strings.Contains(stderr.String(), "Usage:") {
+				output = stderr.String()
+			}
+			for _, each := range tt.contains {
+				if !strings.Contains(output, each) {
+					t.Errorf("output does not contain %q:\n%s", each, output)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, stdout.Bytes())
+			}
+		})
+	}
+}
+
+type unmarshalFunc func(data []byte, v interface{}) error
+
+func checkInspect(unmarshal unmarshalFunc) func(t *testing.T, stdout []byte) {
+	return func(t *testing.T, stdout []byte) {
+		var view inspectView
+		if err := unmarshal(stdout, &view); err != nil {
+			t.Fatalf("failed to unmarshal output: %v\n%s", err, stdout)
+		}
+		if view.Container.ID != webID || view.Container.PID != 4242 || view.Container.Isolation != "process" {
+			t.Errorf("unexpected container: %+v", view.Container)
+		}
+		if view.PodSandbox == nil || view.PodSandbox.UID != podUID || view.PodSandbox.Namespace != "default" {
+			t.Errorf("unexpected pod sandbox: %+v", view.PodSandbox)
+		}
+	}
+}
+
+func checkList(unmarshal unmarshalFunc) func(t *testing.T, stdout []byte) {
+	return func(t *testing.T, stdout []byte) {
+		var views []containerView
+		if err := unmarshal(stdout, &views); err != nil {
+			t.Fatalf("failed to unmarshal output: %v\n%s", err, stdout)
+		}
+		var ids []string
+		for _, view := range views {
+			ids = append(ids, view.ID)
+		}
+		// Containers are sorted by pod namespace, the plain container has none
+		if expected := []string{plainID, webID}; !reflect.DeepEqual(ids, expected) {
+			t.Errorf("unexpected containers: got %v, want %v", ids, expected)
+		}
+	}
+}
+
+func checkSelectors(unmarshal unmarshalFunc) func(t *testing.T, stdout []byte) {
+	return func(t *testing.T, stdout []byte) {
+		var view selectorsView
+		if err := unmarshal(stdout, &view); err != nil {
+			t.Fatalf("failed to unmarshal output: %v\n%s", err, stdout)
+		}
+		expected := []string{
+			"container-image:mcr.microsoft.com/windows/servercore:ltsc2022",
+			"container-name:web",
+			"container-runtime:containerd",
+			"node-name:node1",
+			"ns:default",
+			"pod-image-count:1",
+			"pod-image:mcr.microsoft.com/windows/servercore:ltsc2022",
+			"pod-label:app:web",
+			"pod-name:web-7c9f8d6b5-x2k4p",
+			"pod-uid:" + podUID,
+		}
+		if view.PID != 4242 || view.ContainerID != webID || !reflect.DeepEqual(view.Selectors, expected) {
+			t.Errorf("unexpected selectors: %+v", view)
+		}
+	}
+}
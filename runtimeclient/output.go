@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+func validOutput(output string) bool {
+	switch output {
+	case outputText, outputJSON, outputYAML:
+		return true
+	default:
+		return false
+	}
+}
+
+// write writes the value in the output format, text is written by the
+// provided function to a tab aligned writer
+func write(w io.Writer, output string, v interface{}, text func(tw *tabwriter.Writer)) error {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	default:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		text(tw)
+		return tw.Flush()
+	}
+}
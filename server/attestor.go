@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// podLookup returns the pod selectors of a container, and whether it is a
+// Windows HostProcess container, from the kubelet or the container runtime.
+// When expectedRuntime is set, containers of another runtime fail with
+// process.ErrRuntimeMismatch.
+type podLookup interface {
+	PodByContainer(ctx context.Context, containerID, expectedRuntime string) (selectors []string, hostProcess bool, err error)
+}
+
+// hostProcessPolicy is how processes of HostProcess containers are attested.
+// HostProcess containers run in the host job context, with access to the host,
+// so they are not attested like regular containers by default.
+type hostProcessPolicy string
+
+const (
+	// hostProcessDeny refuses to attest processes of HostProcess containers
+	hostProcessDeny hostProcessPolicy = "deny"
+	// hostProcessSelector attests them with their pod selectors, and the
+	// host-process:true selector
+	hostProcessSelector hostProcessPolicy = "selector"
+	// hostProcessHost attests them as processes that run on the host
+	hostProcessHost hostProcessPolicy = "host"
+)
+
+// parseHostProcessPolicy returns the policy with the given name. An empty name
+// is the selector policy, or the host policy when the container lookup does
+// not detect HostProcess containers. The deny and selector policies are
+// refused in that case, processes of HostProcess containers would be attested
+// as host processes.
+func parseHostProcessPolicy(name string, lookupMethods []string) (hostProcessPolicy, error) {
+	detected := detectsHostProcess(lookupMethods)
+	switch policy := hostProcessPolicy(name); policy {
+	case "":
+		if !detected {
+			return hostProcessHost, nil
+		}
+		return hostProcessSelector, nil
+	case hostProcessDeny, hostProcessSelector:
+		if !detected {
+			return "", fmt.Errorf("HostProcess policy %q requires the %s container lookup with the %s one, the %s lookup reports processes of HostProcess containers as host processes",
+				name, containerLookupCRI, containerLookupJob, containerLookupJob)
+		}
+		return policy, nil
+	case hostProcessHost:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown HostProcess policy %q", name)
+	}
+}
+
+// detectsHostProcess returns false when the job container lookup is used
+// without the cri one. HostProcess containers run in the host job context, the
+// job lookup reports their processes as host processes, and only a cri lookup
+// later in the chain finds their container. The cri lookup matches the child
+// processes of a container through their ancestors, up to its init process.
+func detectsHostProcess(lookupMethods []string) bool {
+	return containsString(lookupMethods, containerLookupCRI) || !containsString(lookupMethods, containerLookupJob)
+}
+
+// attestor resolves the selectors of a workload process. Processes that run
+// in a container are attested with pod selectors, and processes that run on
+// the host with host-level selectors.
+type attestor struct {
+	log       hclog.Logger
+	helper    process.Helper
+	inspector process.Inspector
+	// pods returns the pod selectors of containers, processes of HostProcess
+	// containers are handled as hostProcessPolicy says
+	pods              podLookup
+	hostProcessPolicy hostProcessPolicy
+	// containerRuntime is the expected runtime scheme of containers whose
+	// lookup method does not report it, empty matches any runtime
+	containerRuntime string
+	// timeout is the maximum time to attest a process, zero means no timeout
+	timeout time.Duration
+}
+
+// Attest returns the selectors of the process, and where the process runs.
+// Returned errors are gRPC statuses.
+func (a *attestor) Attest(ctx context.Context, pID int32) (process.Result, []string, error) {
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	result, err := a.helper.GetContainerIDByProcess(ctx, pID)
+	if err != nil {
+		return process.Result{}, nil, containerLookupError(err)
+	}
+
+	switch result.Location {
+	case process.LocationContainer:
+		a.log.Debug("Container found", telemetry.PID, pID, telemetry.ContainerID, result.ContainerID)
+		expectedRuntime, err := a.expectedRuntime(result)
+		if err != nil {
+			return process.Result{}, nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		selectors, hostProcess, err := a.pods.PodByContainer(ctx, result.ContainerID, expectedRuntime)
+		if errors.Is(err, process.ErrRuntimeMismatch) {
+			return process.Result{}, nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		if err != nil {
+			return process.Result{}, nil, status.Errorf(podLookupCode(ctx), "failed to get pod container: %v", err)
+		}
+		if hostProcess {
+			a.log.Debug("Container is a HostProcess container", telemetry.PID, pID, telemetry.ContainerID, result.ContainerID, telemetry.Policy, a.hostProcessPolicy)
+			switch a.hostProcessPolicy {
+			case hostProcessDeny:
+				return process.Result{}, nil, status.Errorf(codes.PermissionDenied, "process %d runs in HostProcess container %s", pID, result.ContainerID)
+			case hostProcessHost:
+				selectors, err := a.hostSelectors(ctx, pID)
+				if err != nil {
+					return process.Result{}, nil, err
+				}
+				return process.Result{Location: process.LocationHost, Resolver: result.Resolver}, selectors, nil
+			}
+		}
+
+		if result.Indirect() {
+			a.log.Debug("Container found through an ancestor", telemetry.PID, pID, telemetry.AncestorPID, result.AncestorPID, telemetry.Depth, result.AncestorDepth)
+			selectors = append(selectors,
+				"container-match:indirect",
+				fmt.Sprintf("container-ancestor-depth:%d", result.AncestorDepth))
+		}
+		if hostProcess {
+			selectors = append(selectors, "host-process:true")
+		}
+		return result, selectors, nil
+
+	case process.LocationHost:
+		a.log.Debug("Process runs on host", telemetry.PID, pID)
+		selectors, err := a.hostSelectors(ctx, pID)
+		if err != nil {
+			return process.Result{}, nil, err
+		}
+		return result, selectors, nil
+
+	default:
+		return process.Result{}, nil, status.Errorf(codes.PermissionDenied, "unable to determine if process %d runs in a container", pID)
+	}
+}
+
+// expectedRuntime returns the runtime the pod source must report the container
+// with: the runtime the lookup found it with, or the configured one when the
+// lookup method does not know it
+func (a *attestor) expectedRuntime(result process.Result) (string, error) {
+	switch {
+	case result.Runtime == "":
+		return a.containerRuntime, nil
+	case a.containerRuntime != "" && result.Runtime != a.containerRuntime:
+		return "", fmt.Errorf("%w: container %s found by %s with runtime %q, expected %q",
+			process.ErrRuntimeMismatch, result.ContainerID, result.Resolver, result.Runtime, a.containerRuntime)
+	default:
+		return result.Runtime, nil
+	}
+}
+
+// hostSelectors returns the host-level selectors of the process
+func (a *attestor) hostSelectors(ctx context.Context, pID int32) ([]string, error) {
+	selectors, err := a.inspector.Selectors(ctx, pID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get host process selectors: %v", err)
+	}
+	return selectors, nil
+}
+
+// containerLookupError converts an error returned by the process helper to a gRPC status
+func containerLookupError(err error) error {
+	switch {
+	case errors.Is(err, process.ErrHyperVIsolation):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, process.ErrResolverMismatch):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "failed to get containerID by Process: %v", err)
+	case errors.Is(err, context.Canceled):
+		return status.Errorf(codes.Canceled, "failed to get containerID by Process: %v", err)
+	}
+	return status.Errorf(codes.Internal, "failed to get containerID by Process: %v", err)
+}
+
+// podLookupCode returns DeadlineExceeded or Canceled when the pod lookup
+// failed because of the context, and Internal otherwise
+func podLookupCode(ctx context.Context) codes.Code {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case context.Canceled:
+		return codes.Canceled
+	default:
+		return codes.Internal
+	}
+}
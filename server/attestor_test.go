@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/cri"
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeHelper struct {
+	result process.Result
+	err    error
+}
+
+func (h *fakeHelper) GetContainerIDByProcess(context.Context, int32) (process.Result, error) {
+	return h.result, h.err
+}
+
+type fakeInspector struct {
+	selectors []string
+}
+
+func (i *fakeInspector) Selectors(context.Context, int32) ([]string, error) {
+	return i.selectors, nil
+}
+
+// fakePods counts the lookups, the selectors and HostProcess flag must come
+// from a single one
+type fakePods struct {
+	selectors   []string
+	hostProcess bool
+	err         error
+	lookups     int
+	// runtime is the runtime of the pod containers, empty matches any
+	runtime         string
+	expectedRuntime string
+	// wait makes the lookup wait until the context is done
+	wait bool
+}
+
+func (p *fakePods) PodByContainer(ctx context.Context, _ string, expectedRuntime string) ([]string, bool, error) {
+	p.lookups++
+	p.expectedRuntime = expectedRuntime
+	if p.wait {
+		<-ctx.Done()
+		return nil, false, fmt.Errorf("failed to list pods: %w", ctx.Err())
+	}
+	if p.runtime != "" && expectedRuntime != "" && p.runtime != expectedRuntime {
+		return nil, false, process.ErrRuntimeMismatch
+	}
+	return p.selectors, p.hostProcess, p.err
+}
+
+func TestParseHostProcessPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		policy        string
+		lookupMethods []string
+		expected      hostProcessPolicy
+		expectErr     bool
+	}{
+		{name: "default with cri", lookupMethods: []string{"cri"}, expected: hostProcessSelector},
+		{name: "default with job and cri", lookupMethods: []string{"job", "cri"}, expected: hostProcessSelector},
+		{name: "default with job", lookupMethods: []string{"job"}, expected: hostProcessHost},
+		{name: "default with cgroups", lookupMethods: []string{"cgroups"}, expected: hostProcessSelector},
+		{name: "deny with job and cri", policy: "deny", lookupMethods: []string{"job", "cri"}, expected: hostProcessDeny},
+		{name: "deny with job", policy: "deny", lookupMethods: []string{"job"}, expectErr: true},
+		{name: "selector with job", policy: "selector", lookupMethods: []string{"job"}, expectErr: true},
+		{name: "host with job", policy: "host", lookupMethods: []string{"job"}, expected: hostProcessHost},
+		{name: "unknown", policy: "allow", lookupMethods: []string{"cri"}, expectErr: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := parseHostProcessPolicy(tt.policy, tt.lookupMethods)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if policy != tt.expected {
+				t.Errorf("unexpected policy: got %q, want %q", policy, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAttestorAttest(t *testing.T) {
+	container := process.Result{Location: process.LocationContainer, ContainerID: "a1b2c3d4e5f6"}
+	hostSelectors := []string{"windows:user_name:NT AUTHORITY\\SYSTEM"}
+	podSelectors := []string{"ns:kube-system"}
+
+	for _, tt := range []struct {
+		name        string
+		result      process.Result
+		helperErr   error
+		hostProcess bool
+		podsErr     error
+		policy      hostProcessPolicy
+		// podRuntime is the runtime of the pod container, containerRuntime
+		// the configured one
+		podRuntime       string
+		containerRuntime string
+		// noPodLookup is set when the attestation fails before the pod lookup
+		noPodLookup bool
+		// podsWait makes the pod lookup wait until the attestation times out,
+		// or is canceled when cancel is set
+		podsWait   bool
+		timeout    time.Duration
+		cancel     bool
+		expected   []string
+		location   process.Location
+		expectCode codes.Code
+	}{
+		{
+			name:     "container",
+			result:   container,
+			policy:   hostProcessDeny,
+			expected: podSelectors,
+			location: process.LocationContainer,
+		},
+		{
+			name:     "indirect container",
+			result:   process.Result{Location: process.LocationContainer, ContainerID: "a1b2c3d4e5f6", AncestorPID: 100, AncestorDepth: 2},
+			policy:   hostProcessSelector,
+			expected: []string{"ns:kube-system", "container-match:indirect", "container-ancestor-depth:2"},
+			location: process.LocationContainer,
+		},
+		{
+			name:        "host process denied",
+			result:      container,
+			hostProcess: true,
+			policy:      hostProcessDeny,
+			expectCode:  codes.PermissionDenied,
+		},
+		{
+			name:        "host process selector",
+			result:      container,
+			hostProcess: true,
+			policy:      hostProcessSelector,
+			expected:    []string{"ns:kube-system", "host-process:true"},
+			location:    process.LocationContainer,
+		},
+		{
+			name:        "host process as host",
+			result:      container,
+			hostProcess: true,
+			policy:      hostProcessHost,
+			expected:    hostSelectors,
+			location:    process.LocationHost,
+		},
+		{
+			name:       "pod lookup failure",
+			result:     container,
+			podsErr:    errors.New("oh no"),
+			policy:     hostProcessSelector,
+			expectCode: codes.Internal,
+		},
+		{
+			name:       "runtime of the lookup",
+			result:     process.Result{Location: process.LocationContainer, ContainerID: "a1b2c3d4e5f6", Runtime: "containerd"},
+			podRuntime: "containerd",
+			policy:     hostProcessSelector,
+			expected:   podSelectors,
+			location:   process.LocationContainer,
+		},
+		{
+			// e.g. a Docker container ID reused by containerd on a migrated node
+			name:       "runtime mismatch of the lookup",
+			result:     process.Result{Location: process.LocationContainer, ContainerID: "a1b2c3d4e5f6", Runtime: "containerd"},
+			podRuntime: "docker",
+			policy:     hostProcessSelector,
+			expectCode: codes.PermissionDenied,
+		},
+		{
+			name:             "configured runtime mismatch",
+			result:           container,
+			podRuntime:       "docker",
+			containerRuntime: "containerd",
+			policy:           hostProcessSelector,
+			expectCode:       codes.PermissionDenied,
+		},
+		{
+			name:             "lookup and configured runtimes disagree",
+			result:           process.Result{Location: process.LocationContainer, ContainerID: "a1b2c3d4e5f6", Runtime: "docker"},
+			containerRuntime: "containerd",
+			policy:           hostProcessSelector,
+			noPodLookup:      true,
+			expectCode:       codes.PermissionDenied,
+		},
+		{
+			name:     "host",
+			result:   process.Result{Location: process.LocationHost},
+			policy:   hostProcessDeny,
+			expected: hostSelectors,
+			location: process.LocationHost,
+		},
+		{
+			name:       "indeterminate",
+			result:     process.Result{Location: process.LocationIndeterminate},
+			policy:     hostProcessSelector,
+			expectCode: codes.PermissionDenied,
+		},
+		{
+			name:       "container lookup deadline exceeded",
+			helperErr:  fmt.Errorf("handle scan interrupted: %w", context.DeadlineExceeded),
+			policy:     hostProcessSelector,
+			expectCode: codes.DeadlineExceeded,
+		},
+		{
+			name:       "container lookup canceled",
+			helperErr:  fmt.Errorf("handle scan interrupted: %w", context.Canceled),
+			policy:     hostProcessSelector,
+			expectCode: codes.Canceled,
+		},
+		{
+			name:       "pod lookup deadline exceeded",
+			result:     container,
+			podsWait:   true,
+			timeout:    time.Millisecond,
+			policy:     hostProcessSelector,
+			expectCode: codes.DeadlineExceeded,
+		},
+		{
+			name:       "pod lookup canceled",
+			result:     container,
+			podsWait:   true,
+			cancel:     true,
+			policy:     hostProcessSelector,
+			expectCode: codes.Canceled,
+		},
+		{
+			name:       "hyper-v",
+			helperErr:  process.ErrHyperVIsolation,
+			policy:     hostProcessSelector,
+			expectCode: codes.FailedPrecondition,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			pods := &fakePods{
+				selectors:   append([]string{}, podSelectors...),
+				hostProcess: tt.hostProcess,
+				err:         tt.podsErr,
+				runtime:     tt.podRuntime,
+				wait:        tt.podsWait,
+			}
+			a := &attestor{
+				log:               hclog.NewNullLogger(),
+				helper:            &fakeHelper{result: tt.result, err: tt.helperErr},
+				inspector:         &fakeInspector{selectors: hostSelectors},
+				pods:              pods,
+				hostProcessPolicy: tt.policy,
+				containerRuntime:  tt.containerRuntime,
+				timeout:           tt.timeout,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			result, selectors, err := a.Attest(ctx, 4242)
+			if tt.result.Location == process.LocationContainer && !tt.noPodLookup && pods.lookups != 1 {
+				t.Errorf("expected one pod lookup, got %d", pods.lookups)
+			}
+			if tt.expectCode != codes.OK {
+				if code := status.Code(err); code != tt.expectCode {
+					t.Fatalf("unexpected error code %s: %v", code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Location != tt.location {
+				t.Errorf("unexpected location: got %s, want %s", result.Location, tt.location)
+			}
+			if !reflect.DeepEqual(selectors, tt.expected) {
+				t.Errorf("unexpected selectors: got %v, want %v", selectors, tt.expected)
+			}
+		})
+	}
+}
+
+// fakeResolver knows the init processes of containers by PID, other lookups
+// are not used by the cri helper
+type fakeResolver struct {
+	cri.Resolver
+	containers map[int32]*cri.Container
+}
+
+func (r *fakeResolver) ContainerByPID(_ context.Context, pID int32) (*cri.Container, error) {
+	if container, ok := r.containers[pID]; ok {
+		return container, nil
+	}
+	return nil, cri.ErrContainerNotFound
+}
+
+type fakeAncestry map[int32][]int32
+
+func (a fakeAncestry) Ancestors(_ context.Context, pID int32) ([]int32, error) {
+	return a[pID], nil
+}
+
+func TestAttestorHostProcessChild(t *testing.T) {
+	// The init process of a HostProcess container runs in the host job
+	// context, like the child it created
+	const initPID, childPID = 5151, 5252
+	resolver := &fakeResolver{containers: map[int32]*cri.Container{
+		initPID: {ID: "a1b2c3d4e5f6", PID: initPID},
+	}}
+	ancestry := fakeAncestry{childPID: {initPID, 4}}
+	helper := process.NewChainHelper(hclog.NewNullLogger(), nil, []process.NamedHelper{
+		{Name: containerLookupJob, Helper: &fakeHelper{result: process.Result{Location: process.LocationHost}}},
+		{Name: containerLookupCRI, Helper: cri.NewHelper(hclog.NewNullLogger(), resolver, ancestry, "containerd")},
+	}, false)
+
+	for _, pID := range []int32{initPID, childPID} {
+		pods := &fakePods{selectors: []string{"ns:kube-system"}, hostProcess: true}
+		a := &attestor{
+			log:               hclog.NewNullLogger(),
+			helper:            helper,
+			inspector:         &fakeInspector{selectors: []string{"windows:user_name:NT AUTHORITY\\SYSTEM"}},
+			pods:              pods,
+			hostProcessPolicy: hostProcessDeny,
+		}
+
+		_, _, err := a.Attest(context.Background(), pID)
+		if code := status.Code(err); code != codes.PermissionDenied {
+			t.Errorf("unexpected error code %s for process %d: %v", code, pID, err)
+		}
+		if pods.lookups != 1 {
+			t.Errorf("expected one pod lookup for process %d, got %d", pID, pods.lookups)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	defaultRefreshInterval = 10 * time.Second
+
+	// defaultMinRefreshInterval is the minimum time between refreshes caused by
+	// lookups of processes that are not indexed
+	defaultMinRefreshInterval = time.Second
+)
+
+// CachedResolver is a Resolver that keeps the containers of the runtime indexed
+// by PID. The index is refreshed incrementally, only the status of containers
+// that were not seen in a previous ListContainers call is requested, so once
+// warm a lookup costs a map access plus a status call that confirms the
+// container is still running.
+type CachedResolver struct {
+	*resolver
+	metrics *telemetry.Metrics
+
+	// minRefreshInterval is the minimum time between refreshes caused by
+	// lookups of processes that are not indexed
+	minRefreshInterval time.Duration
+
+	// refreshMtx serializes refreshes, mtx guards the index
+	refreshMtx sync.Mutex
+	mtx        sync.Mutex
+	containers map[string]*cachedContainer
+	byPID      map[uint32]*Container
+	// refreshedAt is when the last successful refresh started
+	refreshedAt time.Time
+
+	events broadcaster
+}
+
+type cachedContainer struct {
+	id        string
+	createdAt int64
+	state     runtimeapi.ContainerState
+	// container is nil when the container status has no usable info,
+	// so it is not requested again on every refresh
+	container *Container
+}
+
+// NewCachedResolver creates a CachedResolver, the index is filled on the
+// first lookup or refresh.
+func NewCachedResolver(log hclog.Logger, metrics *telemetry.Metrics, client runtimeapi.RuntimeServiceClient) *CachedResolver {
+	return &CachedResolver{
+		resolver: &resolver{
+			log:    log,
+			client: client,
+		},
+		metrics:            metrics,
+		minRefreshInterval: defaultMinRefreshInterval,
+		containers:         make(map[string]*cachedContainer),
+		byPID:              make(map[uint32]*Container),
+	}
+}
+
+// ContainerByPID returns the indexed container of the process. The index is
+// refreshed when the process is not found, or when the indexed container is no
+// longer running, unless it was refreshed less than minRefreshInterval ago:
+// most processes not found are host processes, a refresh for each of them
+// would list all the containers on every lookup. A container started since the
+// last refresh is found once its start event is received or after that
+// interval.
+func (r *CachedResolver) ContainerByPID(ctx context.Context, pID int32) (*Container, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "cri.CachedResolver.ContainerByPID")
+	span.SetAttributes(telemetry.AttrPID.Int64(int64(pID)))
+	defer span.End()
+
+	if pID <= 0 {
+		return nil, ErrContainerNotFound
+	}
+
+	if container, ok := r.get(uint32(pID)); ok {
+		running, err := r.isRunning(ctx, container.ID)
+		if err != nil {
+			return nil, err
+		}
+		if running {
+			r.metrics.IncrCacheLookup("cri_container", true)
+			return container, nil
+		}
+	}
+	r.metrics.IncrCacheLookup("cri_container", false)
+
+	if r.refreshedWithin(r.minRefreshInterval) {
+		return nil, ErrContainerNotFound
+	}
+	if err := r.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	if container, ok := r.get(uint32(pID)); ok {
+		return container, nil
+	}
+	return nil, ErrContainerNotFound
+}
+
+// Refresh lists the containers of the runtime and updates the index with the
+// differences since the previous refresh.
+func (r *CachedResolver) Refresh(ctx context.Context) error {
+	r.refreshMtx.Lock()
+	defer r.refreshMtx.Unlock()
+
+	// Containers created after the list are not indexed, so the time is taken before it
+	startedAt := time.Now()
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	seen := make(map[string]bool, len(resp.Containers))
+	for _, each := range resp.Containers {
+		seen[each.Id] = true
+
+		// The PID is only known once the container started, request the
+		// status again when a known container starts running
+		cached, ok := r.cached(each.Id)
+		started := ok && cached.state != runtimeapi.ContainerState_CONTAINER_RUNNING &&
+			each.State == runtimeapi.ContainerState_CONTAINER_RUNNING
+		if ok && cached.createdAt == each.CreatedAt && !started {
+			if cached.state != each.State {
+				r.setState(each.Id, each.State)
+			}
+			continue
+		}
+
+		container, err := r.containerStatus(ctx, each)
+		var infoErr *infoError
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &infoErr):
+			// Containers with unusable info are kept to not request them again
+			r.log.Debug("Unable to parse container info", telemetry.ContainerID, each.Id, telemetry.Error, err)
+		case err != nil:
+			// Failed status calls are retried on the next refresh
+			r.log.Debug("Unable to get container status", telemetry.ContainerID, each.Id, telemetry.Error, err)
+			continue
+		}
+
+		r.set(each.Id, &cachedContainer{
+			id:        each.Id,
+			createdAt: each.CreatedAt,
+			state:     each.State,
+			container: container,
+		})
+	}
+
+	r.removeUnseen(seen)
+
+	r.mtx.Lock()
+	r.refreshedAt = startedAt
+	r.mtx.Unlock()
+	return nil
+}
+
+// refreshedWithin returns true when the last successful refresh started less
+// than the given duration ago
+func (r *CachedResolver) refreshedWithin(d time.Duration) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return !r.refreshedAt.IsZero() && time.Since(r.refreshedAt) < d
+}
+
+// isRunning returns true when the container is still running, the PID of a
+// running container can not be reused by another process
+func (r *CachedResolver) isRunning(ctx context.Context, id string) (bool, error) {
+	resp, err := r.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id})
+	switch {
+	case status.Code(err) == codes.NotFound:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to get container status: %w", err)
+	case resp.Status == nil:
+		return false, nil
+	}
+
+	if resp.Status.State != runtimeapi.ContainerState_CONTAINER_RUNNING {
+		r.setState(id, resp.Status.State)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (r *CachedResolver) get(pID uint32) (*Container, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	container, ok := r.byPID[pID]
+	return container, ok
+}
+
+func (r *CachedResolver) cached(id string) (*cachedContainer, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	cached, ok := r.containers[id]
+	return cached, ok
+}
+
+func (r *CachedResolver) set(id string, cached *cachedContainer) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if old, ok := r.containers[id]; ok {
+		replaced := old.createdAt != cached.createdAt || cached.state != runtimeapi.ContainerState_CONTAINER_RUNNING
+		if old.state == runtimeapi.ContainerState_CONTAINER_RUNNING && replaced {
+			r.stoppedLocked(old)
+		}
+		r.unindexLocked(old)
+	}
+	r.containers[id] = cached
+	r.indexLocked(cached)
+}
+
+// setState updates the state of a container, only running containers are
+// indexed by PID
+func (r *CachedResolver) setState(id string, state runtimeapi.ContainerState) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	cached, ok := r.containers[id]
+	if !ok {
+		return
+	}
+	if cached.state == runtimeapi.ContainerState_CONTAINER_RUNNING && state != runtimeapi.ContainerState_CONTAINER_RUNNING {
+		r.stoppedLocked(cached)
+	}
+	r.unindexLocked(cached)
+	cached.state = state
+	r.indexLocked(cached)
+}
+
+// remove removes a container from the index
+func (r *CachedResolver) remove(id string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.removeLocked(id)
+}
+
+func (r *CachedResolver) removeUnseen(seen map[string]bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for id := range r.containers {
+		if !seen[id] {
+			r.removeLocked(id)
+		}
+	}
+}
+
+func (r *CachedResolver) removeLocked(id string) {
+	if cached, ok := r.containers[id]; ok {
+		if cached.state == runtimeapi.ContainerState_CONTAINER_RUNNING {
+			r.stoppedLocked(cached)
+		}
+		r.unindexLocked(cached)
+		delete(r.containers, id)
+	}
+}
+
+// stoppedLocked publishes that a running container stopped. Containers without
+// usable info are published without PID, other lookups may have attested them.
+func (r *CachedResolver) stoppedLocked(cached *cachedContainer) {
+	event := ContainerEvent{ContainerID: cached.id}
+	if cached.container != nil {
+		event.PID = cached.container.PID
+	}
+	r.log.Debug("Container stopped", telemetry.ContainerID, event.ContainerID, telemetry.PID, event.PID)
+	r.events.publish(event)
+}
+
+func (r *CachedResolver) indexLocked(cached *cachedContainer) {
+	if cached.container == nil || cached.state != runtimeapi.ContainerState_CONTAINER_RUNNING {
+		return
+	}
+	if hostPID, ok := cached.container.hostPID(); ok {
+		r.byPID[hostPID] = cached.container
+	}
+}
+
+func (r *CachedResolver) unindexLocked(cached *cachedContainer) {
+	if cached.container == nil {
+		return
+	}
+	if indexed, ok := r.byPID[cached.container.PID]; ok && indexed == cached.container {
+		delete(r.byPID, cached.container.PID)
+	}
+}
@@ -0,0 +1,244 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestCachedResolverContainerByPID(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewCachedResolver(hclog.NewNullLogger(), nil, client)
+	ctx := context.Background()
+
+	// The first lookup fills the index, the containers with malformed,
+	// missing or pid-less info are not indexed
+	container, err := r.ContainerByPID(ctx, webPID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, webID, webPID)
+
+	container, err = r.ContainerByPID(ctx, hostProcessPID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, hostProcessID, hostProcessPID)
+
+	for _, pID := range []int32{0, -1, hyperVPID, 9999} {
+		if _, err := r.ContainerByPID(ctx, pID); !errors.Is(err, ErrContainerNotFound) {
+			t.Errorf("expected ErrContainerNotFound for PID %d, got %v", pID, err)
+		}
+	}
+
+	for _, id := range []string{malformedID, missingPIDID, noInfoID} {
+		if _, ok := r.cached(id); !ok {
+			t.Errorf("expected container %s to be cached", id)
+		}
+	}
+}
+
+func TestCachedResolverRefreshInterval(t *testing.T) {
+	f, client := serveFixture(t)
+	r := NewCachedResolver(hclog.NewNullLogger(), nil, client)
+	ctx := context.Background()
+
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	f.AddContainer(&FakeContainer{
+		ID:    "c4d5e6f7a8b9",
+		Name:  "late",
+		Image: "mcr.microsoft.com/windows/nanoserver:ltsc2022",
+		Info:  json.RawMessage(`{"pid": 8484, "config": {}, "runtimeSpec": {"windows": {}}}`),
+	})
+
+	// Processes that are not indexed do not refresh the index again right away,
+	// e.g. host processes looked up after a container process
+	if _, err := r.ContainerByPID(ctx, 8484); !errors.Is(err, ErrContainerNotFound) {
+		t.Fatalf("expected ErrContainerNotFound, got %v", err)
+	}
+
+	r.minRefreshInterval = 0
+	container, err := r.ContainerByPID(ctx, 8484)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, "c4d5e6f7a8b9", 8484)
+}
+
+func TestCachedResolverStoppedContainer(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewCachedResolver(hclog.NewNullLogger(), nil, client)
+	ctx := context.Background()
+
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	sub := r.Subscribe()
+	defer sub.Close()
+
+	if _, err := client.StopContainer(ctx, &runtimeapi.StopContainerRequest{ContainerId: webID}); err != nil {
+		t.Fatalf("failed to stop container: %v", err)
+	}
+
+	// The indexed container is confirmed to run before it is returned
+	if _, err := r.ContainerByPID(ctx, webPID); !errors.Is(err, ErrContainerNotFound) {
+		t.Errorf("expected ErrContainerNotFound, got %v", err)
+	}
+	expectEvent(t, sub, ContainerEvent{ContainerID: webID, PID: webPID})
+}
+
+func TestCachedResolverStoppedContainerWithoutInfo(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewCachedResolver(hclog.NewNullLogger(), nil, client)
+	ctx := context.Background()
+
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	sub := r.Subscribe()
+	defer sub.Close()
+
+	// Other lookups may have attested the container, its identity must be revoked
+	if _, err := client.StopContainer(ctx, &runtimeapi.StopContainerRequest{ContainerId: malformedID}); err != nil {
+		t.Fatalf("failed to stop container: %v", err)
+	}
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	expectEvent(t, sub, ContainerEvent{ContainerID: malformedID})
+}
+
+func TestCachedResolverRemovedContainer(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewCachedResolver(hclog.NewNullLogger(), nil, client)
+	ctx := context.Background()
+
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	sub := r.Subscribe()
+	defer sub.Close()
+
+	for _, id := range []string{webID, malformedID} {
+		if _, err := client.RemoveContainer(ctx, &runtimeapi.RemoveContainerRequest{ContainerId: id}); err != nil {
+			t.Fatalf("failed to remove container: %v", err)
+		}
+	}
+
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if _, ok := r.get(webPID); ok {
+		t.Error("expected removed container to be unindexed")
+	}
+	for _, id := range []string{webID, malformedID} {
+		if _, ok := r.cached(id); ok {
+			t.Errorf("expected removed container %s to be forgotten", id)
+		}
+	}
+	expectEvents(t, sub, ContainerEvent{ContainerID: webID, PID: webPID}, ContainerEvent{ContainerID: malformedID})
+}
+
+func TestCachedResolverRun(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		eventsSupported bool
+	}{
+		{name: "events", eventsSupported: true},
+		{name: "polling", eventsSupported: false},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f, client := serveFixture(t)
+			f.SetContainerEventsSupported(tt.eventsSupported)
+			r := NewCachedResolver(hclog.NewNullLogger(), nil, client)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- r.Run(ctx)
+			}()
+			defer func() {
+				cancel()
+				if err := <-done; err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+
+			// Run refreshes the index before watching the events
+			waitFor(t, func() bool {
+				_, ok := r.get(webPID)
+				return ok
+			})
+			if !tt.eventsSupported {
+				return
+			}
+
+			sub := r.Subscribe()
+			defer sub.Close()
+			if _, err := client.StopContainer(ctx, &runtimeapi.StopContainerRequest{ContainerId: webID}); err != nil {
+				t.Fatalf("failed to stop container: %v", err)
+			}
+			expectEvent(t, sub, ContainerEvent{ContainerID: webID, PID: webPID})
+			if _, ok := r.get(webPID); ok {
+				t.Error("expected stopped container to be unindexed")
+			}
+		})
+	}
+}
+
+func expectEvent(t *testing.T, sub *Subscription, expected ContainerEvent) {
+	t.Helper()
+	select {
+	case event, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		if event != expected {
+			t.Errorf("unexpected event: got %+v, want %+v", event, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event %+v", expected)
+	}
+}
+
+// expectEvents expects the events in any order
+func expectEvents(t *testing.T, sub *Subscription, expected ...ContainerEvent) {
+	t.Helper()
+	pending := make(map[ContainerEvent]bool)
+	for _, event := range expected {
+		pending[event] = true
+	}
+	for len(pending) > 0 {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if !pending[event] {
+				t.Fatalf("unexpected event %+v", event)
+			}
+			delete(pending, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for events %v", pending)
+		}
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,135 @@
+// Package cri resolves the container and pod sandbox of a process through the
+// Container Runtime Interface (CRI) of the container runtime.
+package cri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// maxMsgSize is the maximum message size of CRI responses, same as the kubelet
+	maxMsgSize = 1024 * 1024 * 16
+)
+
+var (
+	// ErrContainerNotFound is returned when no container runs the process
+	ErrContainerNotFound = errors.New("no container found for process")
+
+	// ErrPodSandboxNotFound is returned when the pod sandbox does not exist
+	ErrPodSandboxNotFound = errors.New("pod sandbox not found")
+
+	// ErrContainerIDNotFound is returned when no container has the ID
+	ErrContainerIDNotFound = errors.New("container not found")
+)
+
+// Container is a container reported by the runtime
+type Container struct {
+	ID           string
+	Name         string
+	PodSandboxID string
+	Image        string
+
+	// PID is the process ID of the container init process. It is a host PID
+	// except for Hyper-V isolated containers, where it is a PID of the utility VM.
+	PID uint32
+
+	// RuntimeType is the runtime that runs the container (e.g. io.containerd.runhcs.v1)
+	RuntimeType string
+
+	// State is the container state reported by the runtime (e.g. CONTAINER_RUNNING)
+	State string
+
+	// Isolation is the isolation mode of Windows containers
+	Isolation Isolation
+
+	// HostProcess is set for Windows HostProcess containers, which run on the
+	// host instead of in a container job
+	HostProcess bool
+
+	// NamedPipes are the host named pipes mounted in the container
+	NamedPipes []string
+
+	// SecurityContext is the requested security context, nil when unknown
+	SecurityContext *SecurityContext
+
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// detailsErr is set when the config or runtime spec could not be parsed,
+	// the isolation, HostProcess and security context may then be unknown
+	detailsErr error
+}
+
+// hostPID returns the PID of the container init process on the host, processes
+// of Hyper-V isolated containers are not visible on the host
+func (c *Container) hostPID() (uint32, bool) {
+	if c.PID == 0 || c.Isolation == IsolationHyperV {
+		return 0, false
+	}
+	return c.PID, true
+}
+
+// PodSandbox is a pod sandbox reported by the runtime
+type PodSandbox struct {
+	ID        string
+	Name      string
+	Namespace string
+	UID       string
+
+	// RuntimeHandler is the runtime class handler used to run the sandbox
+	RuntimeHandler string
+
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Resolver looks up containers and pod sandboxes through the CRI
+type Resolver interface {
+	// ContainerByPID returns the container whose init process is pID, or
+	// ErrContainerNotFound when there is none
+	ContainerByPID(ctx context.Context, pID int32) (*Container, error)
+
+	// PodSandboxByID returns the pod sandbox with the provided ID, or
+	// ErrPodSandboxNotFound when it does not exist
+	PodSandboxByID(ctx context.Context, id string) (*PodSandbox, error)
+
+	// ContainerByID returns the container with the provided ID, or
+	// ErrContainerIDNotFound when it does not exist
+	ContainerByID(ctx context.Context, id string) (*Container, error)
+
+	// ListContainers returns the containers of the runtime. Containers whose
+	// status has no usable info are returned without PID and runtime type.
+	ListContainers(ctx context.Context) ([]*Container, error)
+}
+
+// Dial opens a connection to the CRI endpoint of the runtime, either a Unix
+// socket (unix:///run/containerd/containerd.sock) or a named pipe
+// (npipe:////./pipe/containerd-containerd). The caller must close the returned connection.
+func Dial(ctx context.Context, endpoint string) (*grpc.ClientConn, error) {
+	addr, dialer, err := endpointDialer(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRI endpoint %q: %w", endpoint, err)
+	}
+
+	conn, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dialer),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize)),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to CRI endpoint %q: %w", endpoint, err)
+	}
+	return conn, nil
+}
+
+// NewRuntimeServiceClient creates a client of the CRI runtime service
+func NewRuntimeServiceClient(conn *grpc.ClientConn) runtimeapi.RuntimeServiceClient {
+	return runtimeapi.NewRuntimeServiceClient(conn)
+}
@@ -0,0 +1,179 @@
+package cri
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Isolation is the isolation mode of a Windows container
+type Isolation string
+
+const (
+	// IsolationUnknown is used for containers without a Windows runtime spec
+	IsolationUnknown Isolation = ""
+	// IsolationProcess containers share the kernel of the host
+	IsolationProcess Isolation = "process"
+	// IsolationHyperV containers run in a utility VM
+	IsolationHyperV Isolation = "hyperv"
+)
+
+const (
+	// hostProcessAnnotation is set by containerd on the runtime spec of HostProcess containers
+	hostProcessAnnotation = "microsoft.com/hostprocess-container"
+
+	// namedPipePrefix is the prefix of the host path of named pipes
+	namedPipePrefix = `\\.\pipe\`
+
+	// runhcsHyperVIsolation is the sandbox_isolation value of the runhcs
+	// runtime options for Hyper-V isolated sandboxes
+	runhcsHyperVIsolation = 1
+)
+
+// SecurityContext is the security context requested for a container
+type SecurityContext struct {
+	// RunAsUsername is the user name the container process runs as
+	RunAsUsername string
+	// RunAsUser and RunAsGroup are the uid and gid of Linux containers
+	RunAsUser  *int64
+	RunAsGroup *int64
+
+	Privileged     bool
+	ReadonlyRootfs bool
+	HostProcess    bool
+
+	// GMSA is set when a group Managed Service Account credential spec is used
+	GMSA bool
+}
+
+// runhcsOptions holds the fields used from the runhcs runtime options
+type runhcsOptions struct {
+	// SandboxIsolation is an enum, marshaled as a number or as its name
+	SandboxIsolation json.RawMessage `json:"sandbox_isolation"`
+}
+
+// deriveDetails sets the facts derived from the container config, runtime spec
+// and runtime options of the verbose info. The config and runtime spec are
+// parsed separately, the facts of one that fails to parse are left unknown and
+// the error is returned.
+func deriveDetails(container *Container, info *containerInfo) error {
+	var errs []string
+
+	config, err := parseConfig(info.Config)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	spec, err := parseRuntimeSpec(info.RuntimeSpec)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	container.Isolation = isolation(spec, info.RuntimeOptions)
+	container.SecurityContext = securityContext(config)
+	container.HostProcess = container.SecurityContext != nil && container.SecurityContext.HostProcess
+	if spec != nil {
+		if spec.Annotations[hostProcessAnnotation] == "true" {
+			container.HostProcess = true
+		}
+		for _, mount := range spec.Mounts {
+			if strings.HasPrefix(strings.ToLower(mount.Source), namedPipePrefix) {
+				container.NamedPipes = append(container.NamedPipes, mount.Source)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// parseConfig parses the container config of the verbose info, nil when absent
+func parseConfig(data json.RawMessage) (*runtimeapi.ContainerConfig, error) {
+	if isNullJSON(data) {
+		return nil, nil
+	}
+	config := new(runtimeapi.ContainerConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	return config, nil
+}
+
+// parseRuntimeSpec parses the runtime spec of the verbose info, nil when absent
+func parseRuntimeSpec(data json.RawMessage) (*specs.Spec, error) {
+	if isNullJSON(data) {
+		return nil, nil
+	}
+	spec := new(specs.Spec)
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal runtime spec: %w", err)
+	}
+	return spec, nil
+}
+
+func isNullJSON(data json.RawMessage) bool {
+	return len(data) == 0 || string(data) == "null"
+}
+
+// isolation returns the isolation mode from the Windows section of the runtime
+// spec, or from the runhcs runtime options when there is no spec
+func isolation(spec *specs.Spec, runtimeOptions json.RawMessage) Isolation {
+	if spec != nil && spec.Windows != nil {
+		if spec.Windows.HyperV != nil {
+			return IsolationHyperV
+		}
+		return IsolationProcess
+	}
+
+	if len(runtimeOptions) == 0 {
+		return IsolationUnknown
+	}
+	var options runhcsOptions
+	if err := json.Unmarshal(runtimeOptions, &options); err != nil || len(options.SandboxIsolation) == 0 {
+		return IsolationUnknown
+	}
+	value := strings.Trim(string(options.SandboxIsolation), `"`)
+	if value == "HYPERVISOR" || value == strconv.Itoa(runhcsHyperVIsolation) {
+		return IsolationHyperV
+	}
+	return IsolationProcess
+}
+
+// securityContext returns the Windows or Linux security context of the config
+func securityContext(config *runtimeapi.ContainerConfig) *SecurityContext {
+	if config == nil {
+		return nil
+	}
+
+	switch {
+	case config.Windows != nil && config.Windows.SecurityContext != nil:
+		sc := config.Windows.SecurityContext
+		return &SecurityContext{
+			RunAsUsername: sc.RunAsUsername,
+			HostProcess:   sc.HostProcess,
+			GMSA:          sc.CredentialSpec != "",
+		}
+	case config.Linux != nil && config.Linux.SecurityContext != nil:
+		sc := config.Linux.SecurityContext
+		securityContext := &SecurityContext{
+			RunAsUsername:  sc.RunAsUsername,
+			Privileged:     sc.Privileged,
+			ReadonlyRootfs: sc.ReadonlyRootfs,
+		}
+		if sc.RunAsUser != nil {
+			securityContext.RunAsUser = &sc.RunAsUser.Value
+		}
+		if sc.RunAsGroup != nil {
+			securityContext.RunAsGroup = &sc.RunAsGroup.Value
+		}
+		return securityContext
+	default:
+		return nil
+	}
+}
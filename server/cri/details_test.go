@@ -0,0 +1,80 @@
+package cri
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDeriveDetails(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		info           containerInfo
+		expectErr      bool
+		isolation      Isolation
+		hostProcess    bool
+		runAsUsername  string
+		namedPipeCount int
+	}{
+		{
+			name:      "no config or runtime spec",
+			info:      containerInfo{Config: json.RawMessage("null")},
+			isolation: IsolationUnknown,
+		},
+		{
+			name: "config and runtime spec",
+			info: containerInfo{
+				Config:      json.RawMessage(`{"windows": {"security_context": {"run_as_username": "ContainerUser"}}}`),
+				RuntimeSpec: json.RawMessage(`{"mounts": [{"source": "\\\\.\\pipe\\wservice"}], "windows": {}}`),
+			},
+			isolation:      IsolationProcess,
+			runAsUsername:  "ContainerUser",
+			namedPipeCount: 1,
+		},
+		{
+			name: "unparsable runtime spec falls back to runtime options",
+			info: containerInfo{
+				Config:         json.RawMessage(`{"windows": {"security_context": {"run_as_username": "ContainerUser"}}}`),
+				RuntimeSpec:    json.RawMessage(`{"mounts": {}}`),
+				RuntimeOptions: json.RawMessage(`{"sandbox_isolation": "HYPERVISOR"}`),
+			},
+			expectErr:     true,
+			isolation:     IsolationHyperV,
+			runAsUsername: "ContainerUser",
+		},
+		{
+			name: "unparsable config with HostProcess runtime spec",
+			info: containerInfo{
+				Config:      json.RawMessage(`{"metadata": "agent"}`),
+				RuntimeSpec: json.RawMessage(`{"annotations": {"microsoft.com/hostprocess-container": "true"}, "windows": {}}`),
+			},
+			expectErr:   true,
+			isolation:   IsolationProcess,
+			hostProcess: true,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			container := new(Container)
+			err := deriveDetails(container, &tt.info)
+			if tt.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if container.Isolation != tt.isolation {
+				t.Errorf("unexpected isolation: got %q, want %q", container.Isolation, tt.isolation)
+			}
+			if container.HostProcess != tt.hostProcess {
+				t.Errorf("unexpected host process: got %t, want %t", container.HostProcess, tt.hostProcess)
+			}
+			var runAsUsername string
+			if container.SecurityContext != nil {
+				runAsUsername = container.SecurityContext.RunAsUsername
+			}
+			if runAsUsername != tt.runAsUsername {
+				t.Errorf("unexpected run as username: got %q, want %q", runAsUsername, tt.runAsUsername)
+			}
+			if len(container.NamedPipes) != tt.namedPipeCount {
+				t.Errorf("unexpected named pipes: %v", container.NamedPipes)
+			}
+		})
+	}
+}
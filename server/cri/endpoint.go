@@ -0,0 +1,94 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ErrNoEndpoint is returned when none of the well-known CRI endpoints exists
+var ErrNoEndpoint = errors.New("no CRI endpoint found")
+
+// statFunc returns the file info of a path, it is os.Stat outside of tests
+type statFunc func(name string) (os.FileInfo, error)
+
+// DetectEndpoint returns the first well-known CRI endpoint of the platform that
+// exists, e.g. the containerd or CRI-O socket.
+func DetectEndpoint() (string, error) {
+	return detectEndpoint(wellKnownEndpoints, os.Stat)
+}
+
+// ResolveEndpoint returns the endpoint when it is set, and detects it otherwise
+func ResolveEndpoint(endpoint string) (string, error) {
+	return resolveEndpoint(endpoint, wellKnownEndpoints, os.Stat)
+}
+
+func resolveEndpoint(endpoint string, endpoints []string, stat statFunc) (string, error) {
+	if endpoint != "" {
+		return endpoint, nil
+	}
+	return detectEndpoint(endpoints, stat)
+}
+
+func detectEndpoint(endpoints []string, stat statFunc) (string, error) {
+	for _, endpoint := range endpoints {
+		if endpointExists(endpoint, stat) {
+			return endpoint, nil
+		}
+	}
+	return "", fmt.Errorf("%w, tried %s", ErrNoEndpoint, strings.Join(endpoints, ", "))
+}
+
+// dialerFunc opens a connection to the address of an endpoint
+type dialerFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// endpointDialer returns the address of the endpoint and the dialer that
+// connects to it, endpoints are Unix sockets or named pipes
+func endpointDialer(endpoint string) (string, dialerFunc, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		return u.Path, dialUnix, nil
+	case "npipe":
+		return pipePath(u), dialPipe, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported protocol %q", u.Scheme)
+	}
+}
+
+func dialUnix(ctx context.Context, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+}
+
+// pipePath returns the path of the named pipe of an npipe endpoint,
+// npipe:////./pipe/name is the pipe \\.\pipe\name
+func pipePath(u *url.URL) string {
+	return strings.ReplaceAll(u.Path, "/", `\`)
+}
+
+// endpointExists returns true when the socket or named pipe of the endpoint exists
+func endpointExists(endpoint string, stat statFunc) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "unix":
+		info, err := stat(u.Path)
+		return err == nil && info.Mode()&os.ModeSocket != 0
+	case "npipe":
+		_, err := stat(pipePath(u))
+		return err == nil
+	default:
+		return false
+	}
+}
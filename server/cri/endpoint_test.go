@@ -0,0 +1,126 @@
+package cri
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveEndpoint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "containerd.sock")
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	// Regular files are not endpoints
+	filePath := filepath.Join(dir, "crio.sock")
+	if err := os.WriteFile(filePath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missingPath := filepath.Join(dir, "missing.sock")
+
+	// statPipes stats named pipes, which only exist on Windows
+	statPipes := func(name string) (os.FileInfo, error) {
+		if name == `\\.\pipe\containerd-containerd` {
+			return nil, nil
+		}
+		return os.Stat(name)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		endpoint  string
+		endpoints []string
+		stat      statFunc
+		expected  string
+		expectErr error
+	}{
+		{
+			name:      "explicit",
+			endpoint:  "unix://" + missingPath,
+			endpoints: []string{"unix://" + socketPath},
+			expected:  "unix://" + missingPath,
+		},
+		{
+			name:      "detected",
+			endpoints: []string{"unix://" + missingPath, "unix://" + filePath, "unix://" + socketPath},
+			expected:  "unix://" + socketPath,
+		},
+		{
+			name:      "detected named pipe",
+			endpoints: []string{"npipe:////./pipe/cri-dockerd", "npipe:////./pipe/containerd-containerd"},
+			stat:      statPipes,
+			expected:  "npipe:////./pipe/containerd-containerd",
+		},
+		{
+			name:      "none found",
+			endpoints: []string{"unix://" + missingPath, "unix://" + filePath, "tcp://localhost:1234", "%zz"},
+			expectErr: ErrNoEndpoint,
+		},
+		{
+			name:      "no well-known endpoints",
+			expectErr: ErrNoEndpoint,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			stat := tt.stat
+			if stat == nil {
+				stat = os.Stat
+			}
+			endpoint, err := resolveEndpoint(tt.endpoint, tt.endpoints, stat)
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) {
+					t.Fatalf("expected %v, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if endpoint != tt.expected {
+				t.Errorf("unexpected endpoint: got %q, want %q", endpoint, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEndpointDialer(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		endpoint  string
+		expected  string
+		expectErr bool
+	}{
+		{name: "unix", endpoint: "unix:///run/containerd/containerd.sock", expected: "/run/containerd/containerd.sock"},
+		{name: "named pipe", endpoint: "npipe:////./pipe/containerd-containerd", expected: `\\.\pipe\containerd-containerd`},
+		{name: "unsupported protocol", endpoint: "tcp://localhost:1234", expectErr: true},
+		{name: "no protocol", endpoint: "/run/containerd/containerd.sock", expectErr: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			addr, dialer, err := endpointDialer(tt.endpoint)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if addr != tt.expected || dialer == nil {
+				t.Errorf("unexpected address %q", addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package cri
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// wellKnownEndpoints are the CRI endpoints detected on Unix, in order of preference
+var wellKnownEndpoints = []string{
+	"unix:///run/containerd/containerd.sock",
+	"unix:///var/run/containerd/containerd.sock",
+	"unix:///var/run/crio/crio.sock",
+	"unix:///var/run/cri-dockerd.sock",
+}
+
+func dialPipe(context.Context, string) (net.Conn, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
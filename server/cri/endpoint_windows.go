@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package cri
+
+import (
+	"context"
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// wellKnownEndpoints are the CRI endpoints detected on Windows, in order of preference
+var wellKnownEndpoints = []string{
+	"npipe:////./pipe/containerd-containerd",
+	"npipe:////./pipe/cri-dockerd",
+}
+
+func dialPipe(ctx context.Context, addr string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, addr)
+}
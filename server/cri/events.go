@@ -0,0 +1,203 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// subscriptionBuffer is the number of events buffered for each subscriber
+	subscriptionBuffer = 64
+
+	defaultReconnectInterval = 5 * time.Second
+)
+
+// ContainerEvent is published when a known container stops running or is removed
+type ContainerEvent struct {
+	ContainerID string
+	// PID is zero when the container info was not usable
+	PID uint32
+}
+
+// Subscription receives the events of containers that stop running
+type Subscription struct {
+	events chan ContainerEvent
+	done   func()
+}
+
+// Events returns the channel of events. It is closed when the subscription is
+// closed, or when the subscriber was too slow and events were dropped, in which
+// case the subscriber must assume any container may have stopped.
+func (s *Subscription) Events() <-chan ContainerEvent {
+	return s.events
+}
+
+// Close stops the delivery of events
+func (s *Subscription) Close() {
+	s.done()
+}
+
+// broadcaster publishes container events to its subscribers without blocking
+type broadcaster struct {
+	mtx         sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+func (b *broadcaster) subscribe() *Subscription {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[*Subscription]struct{})
+	}
+	sub := &Subscription{
+		events: make(chan ContainerEvent, subscriptionBuffer),
+	}
+	var once sync.Once
+	sub.done = func() {
+		once.Do(func() {
+			b.unsubscribe(sub)
+		})
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (b *broadcaster) unsubscribe(sub *Subscription) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (b *broadcaster) publish(event ContainerEvent) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			// Drop the slow subscriber, closing its channel tells it events were lost
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events of known containers that
+// stop running. The caller must close the subscription.
+func (r *CachedResolver) Subscribe() *Subscription {
+	return r.events.subscribe()
+}
+
+// Run keeps the index up to date until the context is done. It follows the
+// container events of the runtime, and falls back to refreshing the index
+// periodically when the runtime does not support GetContainerEvents.
+func (r *CachedResolver) Run(ctx context.Context) error {
+	for {
+		// Catch up with the changes missed while not watching
+		if err := r.Refresh(ctx); err != nil {
+			r.log.Warn("Failed to refresh containers", telemetry.Error, err)
+		}
+
+		err := r.watchEvents(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case status.Code(err) == codes.Unimplemented:
+			r.log.Info("Runtime does not support container events, polling containers")
+			return r.poll(ctx)
+		default:
+			r.log.Warn("Container events stream failed, reconnecting", telemetry.Error, err)
+		}
+
+		select {
+		case <-time.After(defaultReconnectInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// poll refreshes the index periodically, until the context is done.
+func (r *CachedResolver) poll(ctx context.Context) error {
+	ticker := time.NewTicker(defaultRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Refresh(ctx); err != nil {
+				r.log.Warn("Failed to refresh containers", telemetry.Error, err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// watchEvents applies the container events of the runtime to the index, until
+// the stream fails or the context is done
+func (r *CachedResolver) watchEvents(ctx context.Context) error {
+	stream, err := r.client.GetContainerEvents(ctx, &runtimeapi.GetEventsRequest{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch event.ContainerEventType {
+		case runtimeapi.ContainerEventType_CONTAINER_CREATED_EVENT,
+			runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT:
+			if err := r.refreshContainer(ctx, event.ContainerId); err != nil {
+				r.log.Debug("Unable to refresh container", telemetry.ContainerID, event.ContainerId, telemetry.Error, err)
+			}
+		case runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT:
+			r.setState(event.ContainerId, runtimeapi.ContainerState_CONTAINER_EXITED)
+		case runtimeapi.ContainerEventType_CONTAINER_DELETED_EVENT:
+			r.remove(event.ContainerId)
+		}
+	}
+}
+
+// refreshContainer requests the status of a single container and indexes it
+func (r *CachedResolver) refreshContainer(ctx context.Context, id string) error {
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{Id: id},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Containers) == 0 {
+		r.remove(id)
+		return nil
+	}
+
+	each := resp.Containers[0]
+	container, err := r.containerStatus(ctx, each)
+	// Containers with unusable info are kept, to publish when they stop
+	var infoErr *infoError
+	if err != nil && !errors.As(err, &infoErr) {
+		return err
+	}
+	r.set(id, &cachedContainer{
+		id:        id,
+		createdAt: each.CreatedAt,
+		state:     each.State,
+		container: container,
+	})
+	return nil
+}
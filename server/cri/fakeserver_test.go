@@ -0,0 +1,419 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// FakeRuntimeService is an in-memory implementation of the CRI runtime
+// service. It serves the calls used to resolve a process to its container and
+// pod sandbox, and the container events, so the resolvers can be exercised
+// without a container runtime.
+// Other calls return Unimplemented.
+type FakeRuntimeService struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+
+	mtx sync.Mutex
+
+	containers map[string]*FakeContainer
+	sandboxes  map[string]*FakeSandbox
+	// clock is used as creation time of new containers and sandboxes
+	clock int64
+
+	listContainersErr  error
+	containerStatusErr map[string]error
+
+	// eventsUnsupported makes GetContainerEvents return Unimplemented
+	eventsUnsupported bool
+	eventStreams      map[chan *runtimeapi.ContainerEventResponse]struct{}
+}
+
+// Fixture is the content of a fixture file loaded by LoadFakeRuntimeService
+type Fixture struct {
+	Sandboxes  []*FakeSandbox   `json:"sandboxes"`
+	Containers []*FakeContainer `json:"containers"`
+}
+
+// FakeSandbox is a pod sandbox served by FakeRuntimeService
+type FakeSandbox struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	Namespace      string            `json:"namespace"`
+	UID            string            `json:"uid"`
+	RuntimeHandler string            `json:"runtimeHandler"`
+	Labels         map[string]string `json:"labels"`
+	Annotations    map[string]string `json:"annotations"`
+
+	createdAt int64
+}
+
+// FakeContainer is a container served by FakeRuntimeService
+type FakeContainer struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	SandboxID   string            `json:"sandboxId"`
+	Image       string            `json:"image"`
+	Attempt     uint32            `json:"attempt"`
+	Exited      bool              `json:"exited"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+
+	// Info is returned as the "info" entry of the verbose container status.
+	// A JSON string is returned verbatim, which allows to serve malformed
+	// info, any other value is returned as JSON. No entry is returned when empty
+	// or null.
+	Info json.RawMessage `json:"info"`
+
+	createdAt int64
+}
+
+// NewFakeRuntimeService creates a FakeRuntimeService without containers or sandboxes
+func NewFakeRuntimeService() *FakeRuntimeService {
+	return &FakeRuntimeService{
+		containers:         make(map[string]*FakeContainer),
+		sandboxes:          make(map[string]*FakeSandbox),
+		containerStatusErr: make(map[string]error),
+		eventStreams:       make(map[chan *runtimeapi.ContainerEventResponse]struct{}),
+	}
+}
+
+// LoadFakeRuntimeService creates a FakeRuntimeService with the sandboxes and
+// containers of a fixture file
+func LoadFakeRuntimeService(path string) (*FakeRuntimeService, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %w", err)
+	}
+
+	fixture := new(Fixture)
+	if err := json.Unmarshal(data, fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %s: %w", path, err)
+	}
+
+	f := NewFakeRuntimeService()
+	for _, sandbox := range fixture.Sandboxes {
+		f.AddSandbox(sandbox)
+	}
+	for _, container := range fixture.Containers {
+		f.AddContainer(container)
+	}
+	return f, nil
+}
+
+// AddSandbox adds a ready pod sandbox
+func (f *FakeRuntimeService) AddSandbox(sandbox *FakeSandbox) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.clock++
+	sandbox.createdAt = f.clock
+	f.sandboxes[sandbox.ID] = sandbox
+}
+
+// AddContainer adds a container, running unless Exited is set
+func (f *FakeRuntimeService) AddContainer(container *FakeContainer) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.clock++
+	container.createdAt = f.clock
+	f.containers[container.ID] = container
+
+	f.publishLocked(container.ID, runtimeapi.ContainerEventType_CONTAINER_CREATED_EVENT)
+	if !container.Exited {
+		f.publishLocked(container.ID, runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT)
+	}
+}
+
+// RemoveContainer removes a container, removing a missing container is not an error
+func (f *FakeRuntimeService) RemoveContainer(_ context.Context, req *runtimeapi.RemoveContainerRequest) (*runtimeapi.RemoveContainerResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, ok := f.containers[req.ContainerId]; ok {
+		delete(f.containers, req.ContainerId)
+		f.publishLocked(req.ContainerId, runtimeapi.ContainerEventType_CONTAINER_DELETED_EVENT)
+	}
+	return &runtimeapi.RemoveContainerResponse{}, nil
+}
+
+// StopContainer marks a container as exited
+func (f *FakeRuntimeService) StopContainer(_ context.Context, req *runtimeapi.StopContainerRequest) (*runtimeapi.StopContainerResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	container, ok := f.containers[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.ContainerId)
+	}
+	if !container.Exited {
+		container.Exited = true
+		f.publishLocked(container.ID, runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT)
+	}
+	return &runtimeapi.StopContainerResponse{}, nil
+}
+
+// SetListContainersError makes ListContainers fail with the provided error
+func (f *FakeRuntimeService) SetListContainersError(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.listContainersErr = err
+}
+
+// SetContainerStatusError makes ContainerStatus of the container fail with the provided error
+func (f *FakeRuntimeService) SetContainerStatusError(id string, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.containerStatusErr[id] = err
+}
+
+// SetContainerEventsSupported sets whether GetContainerEvents is served, runtimes
+// that predate it return Unimplemented
+func (f *FakeRuntimeService) SetContainerEventsSupported(supported bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.eventsUnsupported = !supported
+}
+
+// Serve registers the fake in a gRPC server that serves on the listener, and
+// returns a function that stops the server
+func (f *FakeRuntimeService) Serve(lis net.Listener) func() {
+	server := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(server, f)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	return server.Stop
+}
+
+func (f *FakeRuntimeService) Version(context.Context, *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	return &runtimeapi.VersionResponse{
+		Version:           "0.1.0",
+		RuntimeName:       "fake",
+		RuntimeVersion:    "0.1.0",
+		RuntimeApiVersion: "v1",
+	}, nil
+}
+
+func (f *FakeRuntimeService) ListContainers(_ context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.listContainersErr != nil {
+		return nil, f.listContainersErr
+	}
+
+	resp := new(runtimeapi.ListContainersResponse)
+	for _, container := range f.sortedContainers() {
+		if filter := req.Filter; filter != nil {
+			if filter.Id != "" && filter.Id != container.ID ||
+				filter.PodSandboxId != "" && filter.PodSandboxId != container.SandboxID ||
+				filter.State != nil && filter.State.State != container.state() ||
+				!matchLabels(filter.LabelSelector, container.Labels) {
+				continue
+			}
+		}
+		resp.Containers = append(resp.Containers, container.toContainer())
+	}
+	return resp, nil
+}
+
+func (f *FakeRuntimeService) ContainerStatus(_ context.Context, req *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if err := f.containerStatusErr[req.ContainerId]; err != nil {
+		return nil, err
+	}
+
+	container, ok := f.containers[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", req.ContainerId)
+	}
+
+	resp := &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{
+			Id:          container.ID,
+			Metadata:    &runtimeapi.ContainerMetadata{Name: container.Name, Attempt: container.Attempt},
+			State:       container.state(),
+			CreatedAt:   container.createdAt,
+			Image:       &runtimeapi.ImageSpec{Image: container.Image},
+			ImageRef:    container.Image,
+			Labels:      container.Labels,
+			Annotations: container.Annotations,
+		},
+	}
+	if req.Verbose {
+		if info, ok := container.info(); ok {
+			resp.Info = map[string]string{"info": info}
+		}
+	}
+	return resp, nil
+}
+
+func (f *FakeRuntimeService) ListPodSandbox(_ context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	ids := make([]string, 0, len(f.sandboxes))
+	for id := range f.sandboxes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	resp := new(runtimeapi.ListPodSandboxResponse)
+	for _, id := range ids {
+		sandbox := f.sandboxes[id]
+		if filter := req.Filter; filter != nil {
+			if filter.Id != "" && filter.Id != sandbox.ID ||
+				filter.State != nil && filter.State.State != runtimeapi.PodSandboxState_SANDBOX_READY ||
+				!matchLabels(filter.LabelSelector, sandbox.Labels) {
+				continue
+			}
+		}
+		resp.Items = append(resp.Items, &runtimeapi.PodSandbox{
+			Id:             sandbox.ID,
+			Metadata:       sandbox.metadata(),
+			State:          runtimeapi.PodSandboxState_SANDBOX_READY,
+			CreatedAt:      sandbox.createdAt,
+			Labels:         sandbox.Labels,
+			Annotations:    sandbox.Annotations,
+			RuntimeHandler: sandbox.RuntimeHandler,
+		})
+	}
+	return resp, nil
+}
+
+func (f *FakeRuntimeService) PodSandboxStatus(_ context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	sandbox, ok := f.sandboxes[req.PodSandboxId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "pod sandbox %q not found", req.PodSandboxId)
+	}
+
+	return &runtimeapi.PodSandboxStatusResponse{
+		Status: &runtimeapi.PodSandboxStatus{
+			Id:             sandbox.ID,
+			Metadata:       sandbox.metadata(),
+			State:          runtimeapi.PodSandboxState_SANDBOX_READY,
+			CreatedAt:      sandbox.createdAt,
+			Labels:         sandbox.Labels,
+			Annotations:    sandbox.Annotations,
+			RuntimeHandler: sandbox.RuntimeHandler,
+		},
+	}, nil
+}
+
+// GetContainerEvents streams the events of the containers added, stopped or
+// removed after the call
+func (f *FakeRuntimeService) GetContainerEvents(_ *runtimeapi.GetEventsRequest, stream runtimeapi.RuntimeService_GetContainerEventsServer) error {
+	f.mtx.Lock()
+	if f.eventsUnsupported {
+		f.mtx.Unlock()
+		return status.Error(codes.Unimplemented, "method GetContainerEvents not implemented")
+	}
+	events := make(chan *runtimeapi.ContainerEventResponse, 64)
+	f.eventStreams[events] = struct{}{}
+	f.mtx.Unlock()
+
+	defer func() {
+		f.mtx.Lock()
+		delete(f.eventStreams, events)
+		f.mtx.Unlock()
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (f *FakeRuntimeService) publishLocked(id string, eventType runtimeapi.ContainerEventType) {
+	event := &runtimeapi.ContainerEventResponse{
+		ContainerId:        id,
+		ContainerEventType: eventType,
+		CreatedAt:          f.clock,
+	}
+	for events := range f.eventStreams {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// sortedContainers returns the containers in creation order
+func (f *FakeRuntimeService) sortedContainers() []*FakeContainer {
+	containers := make([]*FakeContainer, 0, len(f.containers))
+	for _, container := range f.containers {
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].createdAt < containers[j].createdAt
+	})
+	return containers
+}
+
+func (c *FakeContainer) state() runtimeapi.ContainerState {
+	if c.Exited {
+		return runtimeapi.ContainerState_CONTAINER_EXITED
+	}
+	return runtimeapi.ContainerState_CONTAINER_RUNNING
+}
+
+func (c *FakeContainer) info() (string, bool) {
+	if len(c.Info) == 0 || string(c.Info) == "null" {
+		return "", false
+	}
+	var verbatim string
+	if err := json.Unmarshal(c.Info, &verbatim); err == nil {
+		return verbatim, true
+	}
+	return string(c.Info), true
+}
+
+func (c *FakeContainer) toContainer() *runtimeapi.Container {
+	return &runtimeapi.Container{
+		Id:           c.ID,
+		PodSandboxId: c.SandboxID,
+		Metadata:     &runtimeapi.ContainerMetadata{Name: c.Name, Attempt: c.Attempt},
+		Image:        &runtimeapi.ImageSpec{Image: c.Image},
+		ImageRef:     c.Image,
+		State:        c.state(),
+		CreatedAt:    c.createdAt,
+		Labels:       c.Labels,
+		Annotations:  c.Annotations,
+	}
+}
+
+func (s *FakeSandbox) metadata() *runtimeapi.PodSandboxMetadata {
+	return &runtimeapi.PodSandboxMetadata{
+		Name:      s.Name,
+		Uid:       s.UID,
+		Namespace: s.Namespace,
+	}
+}
+
+// matchLabels returns true when labels contain all the selector labels
+func matchLabels(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
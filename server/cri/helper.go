@@ -0,0 +1,78 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+// NewHelper creates a process helper that looks up the container of a process
+// through the CRI, instead of scanning the job handles of vmcompute.
+// The runtime only knows the PID of container init processes, child processes
+// of a container are matched through their ancestors, listed by ancestry, up to
+// the init process. Processes of HostProcess containers are matched this way
+// too, while the job lookup reports them as host processes.
+// Hyper-V isolated containers are never matched, the PID the runtime reports
+// for them is a PID of the utility VM, not of the host.
+// runtimeName is the name of the runtime (see RuntimeName), reported as the
+// runtime of the containers found.
+func NewHelper(log hclog.Logger, resolver Resolver, ancestry process.Ancestry, runtimeName string) process.Helper {
+	return &helper{
+		log:         log,
+		resolver:    resolver,
+		ancestry:    ancestry,
+		runtimeName: runtimeName,
+	}
+}
+
+type helper struct {
+	log         hclog.Logger
+	resolver    Resolver
+	ancestry    process.Ancestry
+	runtimeName string
+}
+
+func (h *helper) GetContainerIDByProcess(ctx context.Context, pID int32) (process.Result, error) {
+	container, err := h.resolver.ContainerByPID(ctx, pID)
+	switch {
+	case err == nil:
+		return h.result(container), nil
+	case !errors.Is(err, ErrContainerNotFound):
+		return process.Result{}, err
+	}
+
+	ancestors, err := h.ancestry.Ancestors(ctx, pID)
+	if err != nil {
+		return process.Result{}, fmt.Errorf("failed to list process ancestors: %w", err)
+	}
+	for i, ancestorPID := range ancestors {
+		container, err := h.resolver.ContainerByPID(ctx, ancestorPID)
+		switch {
+		case errors.Is(err, ErrContainerNotFound):
+			continue
+		case err != nil:
+			return process.Result{}, err
+		}
+
+		h.log.Debug("Found container of ancestor", telemetry.PID, pID, telemetry.AncestorPID, ancestorPID, telemetry.Depth, i+1)
+		result := h.result(container)
+		result.AncestorPID = ancestorPID
+		result.AncestorDepth = i + 1
+		return result, nil
+	}
+
+	h.log.Debug("Process not found in runtime containers", telemetry.PID, pID)
+	return process.Result{Location: process.LocationIndeterminate}, nil
+}
+
+func (h *helper) result(container *Container) process.Result {
+	return process.Result{
+		Location:    process.LocationContainer,
+		ContainerID: container.ID,
+		Runtime:     h.runtimeName,
+	}
+}
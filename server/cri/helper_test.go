@@ -0,0 +1,98 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/hashicorp/go-hclog"
+)
+
+// fakeAncestry returns the ancestors of the processes in the map, or an error
+// for the processes that are not in it
+type fakeAncestry map[int32][]int32
+
+func (a fakeAncestry) Ancestors(_ context.Context, pID int32) ([]int32, error) {
+	ancestors, ok := a[pID]
+	if !ok {
+		return nil, errors.New("process not found")
+	}
+	return ancestors, nil
+}
+
+func TestHelperGetContainerIDByProcess(t *testing.T) {
+	_, client := serveFixture(t)
+	runtimeName, err := RuntimeName(context.Background(), client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ancestry := fakeAncestry{
+		0:    nil,
+		9999: {1},
+		// A process started by a shell of a HostProcess container
+		9002: {9001, hostProcessPID, 1},
+		9003: {webPID, 1},
+		// The Hyper-V worker is not matched through the utility VM PID
+		hyperVPID: {1},
+	}
+	h := NewHelper(hclog.NewNullLogger(), NewResolver(hclog.NewNullLogger(), client), ancestry, runtimeName)
+
+	for _, tt := range []struct {
+		name     string
+		pID      int32
+		expected process.Result
+	}{
+		{
+			name:     "init process",
+			pID:      webPID,
+			expected: process.Result{Location: process.LocationContainer, ContainerID: webID, Runtime: "fake"},
+		},
+		{
+			name:     "host process container",
+			pID:      hostProcessPID,
+			expected: process.Result{Location: process.LocationContainer, ContainerID: hostProcessID, Runtime: "fake"},
+		},
+		{
+			name:     "child process",
+			pID:      9003,
+			expected: process.Result{Location: process.LocationContainer, ContainerID: webID, Runtime: "fake", AncestorPID: webPID, AncestorDepth: 1},
+		},
+		{
+			name:     "descendant of host process container",
+			pID:      9002,
+			expected: process.Result{Location: process.LocationContainer, ContainerID: hostProcessID, Runtime: "fake", AncestorPID: hostProcessPID, AncestorDepth: 2},
+		},
+		{
+			name:     "no container ancestor",
+			pID:      9999,
+			expected: process.Result{Location: process.LocationIndeterminate},
+		},
+		{
+			name:     "utility VM PID",
+			pID:      hyperVPID,
+			expected: process.Result{Location: process.LocationIndeterminate},
+		},
+		{
+			name:     "zero PID",
+			pID:      0,
+			expected: process.Result{Location: process.LocationIndeterminate},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := h.GetContainerIDByProcess(context.Background(), tt.pID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("unexpected result: got %+v, want %+v", result, tt.expected)
+			}
+		})
+	}
+
+	// The process exited before its ancestors were listed
+	if _, err := h.GetContainerIDByProcess(context.Background(), 8888); err == nil {
+		t.Error("expected error when the ancestors can not be listed")
+	}
+}
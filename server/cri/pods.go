@@ -0,0 +1,251 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Labels set by the kubelet on the pod sandboxes and containers it creates
+const (
+	labelPodName       = "io.kubernetes.pod.name"
+	labelPodNamespace  = "io.kubernetes.pod.namespace"
+	labelPodUID        = "io.kubernetes.pod.uid"
+	labelContainerName = "io.kubernetes.container.name"
+
+	// kubernetesLabelPrefix is the prefix of the labels set by the kubelet,
+	// they are not pod labels
+	kubernetesLabelPrefix = "io.kubernetes."
+)
+
+// ErrNotKubernetesContainer is returned when the container was not created by the kubelet
+var ErrNotKubernetesContainer = errors.New("container is not managed by the kubelet")
+
+// PodClient builds the pod selectors of a container from the pod sandbox and
+// container labels of the runtime, for nodes where the kubelet API is not
+// reachable. The runtime does not know the service account, owner references
+// or which containers are init containers, so sa, pod-owner, pod-owner-uid and
+// pod-init-image selectors are not produced, and pod-image covers all the
+// containers of the pod.
+type PodClient struct {
+	log      hclog.Logger
+	client   runtimeapi.RuntimeServiceClient
+	nodeName string
+}
+
+// NewPodClient creates a PodClient. nodeName is used for the node-name
+// selector, it is omitted when empty.
+func NewPodClient(log hclog.Logger, client runtimeapi.RuntimeServiceClient, nodeName string) *PodClient {
+	return &PodClient{
+		log:      log,
+		client:   client,
+		nodeName: nodeName,
+	}
+}
+
+// PodByContainer returns the pod selectors of the container, and whether it
+// runs as a Windows HostProcess container according to its runtime spec or
+// config. Both come from the same container status. It fails when the spec and
+// config could not be parsed and neither says the container is a HostProcess
+// container, and with process.ErrRuntimeMismatch when expectedRuntime is set
+// and the runtime has another name.
+func (c *PodClient) PodByContainer(ctx context.Context, containerID, expectedRuntime string) ([]string, bool, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "cri.PodByContainer")
+	defer span.End()
+	span.SetAttributes(telemetry.AttrContainerID.String(containerID))
+
+	selectors, verboseInfo, err := c.podSelectors(ctx, containerID, expectedRuntime)
+	if err != nil {
+		return nil, false, err
+	}
+
+	info, err := parseContainerInfo(verboseInfo)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to tell whether the container is a HostProcess container: %w", err)
+	}
+	container := new(Container)
+	if err := deriveDetails(container, info); err != nil && !container.HostProcess {
+		return nil, false, fmt.Errorf("unable to tell whether the container is a HostProcess container: %w", err)
+	}
+	return selectors, container.HostProcess, nil
+}
+
+// podSelectors returns the pod selectors of the container, and the verbose info
+// of its status. When expectedRuntime is set, the runtime must have that name.
+func (c *PodClient) podSelectors(ctx context.Context, containerID, expectedRuntime string) ([]string, map[string]string, error) {
+	resp, err := c.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{
+		ContainerId: containerID,
+		Verbose:     true,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get container status: %w", err)
+	}
+	if resp.Status == nil {
+		return nil, nil, fmt.Errorf("container %q has no status", containerID)
+	}
+	container := resp.Status
+
+	podUID := container.Labels[labelPodUID]
+	if podUID == "" {
+		return nil, nil, ErrNotKubernetesContainer
+	}
+	trace.SpanFromContext(ctx).SetAttributes(telemetry.AttrPodUID.String(podUID))
+
+	sandboxes, err := c.client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{
+			LabelSelector: map[string]string{labelPodUID: podUID},
+			State:         &runtimeapi.PodSandboxStateValue{State: runtimeapi.PodSandboxState_SANDBOX_READY},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list pod sandboxes: %w", err)
+	}
+	if len(sandboxes.Items) != 1 {
+		return nil, nil, fmt.Errorf("expected one ready pod sandbox for pod %q, found %d", podUID, len(sandboxes.Items))
+	}
+	sandbox := sandboxes.Items[0]
+
+	podContainers, err := c.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{PodSandboxId: sandbox.Id},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list pod containers: %w", err)
+	}
+
+	runtimeName, err := RuntimeName(ctx, c.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expectedRuntime != "" && runtimeName != expectedRuntime {
+		return nil, nil, fmt.Errorf("%w: container %q found with runtime %q, expected %q", process.ErrRuntimeMismatch, containerID, runtimeName, expectedRuntime)
+	}
+
+	c.log.Debug("Container found in pod sandbox", telemetry.ContainerID, containerID, telemetry.PodUID, podUID, telemetry.PodName, sandbox.Labels[labelPodName])
+	return getSelectorValuesFromSandbox(sandbox, container, podContainers.Containers, runtimeName, c.nodeName), resp.Info, nil
+}
+
+// CheckRuntime verifies the runtime CRI endpoint is reachable
+func (c *PodClient) CheckRuntime(ctx context.Context) error {
+	_, err := c.client.Version(ctx, &runtimeapi.VersionRequest{})
+	return err
+}
+
+// RuntimeName returns the name of the runtime, used as the container runtime
+// scheme (e.g. containerd). It is empty when the runtime does not report it.
+func RuntimeName(ctx context.Context, client runtimeapi.RuntimeServiceClient) (string, error) {
+	resp, err := client.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get runtime version: %w", err)
+	}
+	return resp.RuntimeName, nil
+}
+
+// getSelectorValuesFromSandbox returns the same selectors as the kubelet pod
+// source, for the values the runtime knows
+func getSelectorValuesFromSandbox(sandbox *runtimeapi.PodSandbox, container *runtimeapi.ContainerStatus, podContainers []*runtimeapi.Container, runtimeName, nodeName string) []string {
+	// Like the container statuses of the kubelet pod status, only the current
+	// attempt of each container counts
+	podContainers = currentContainers(podContainers)
+
+	// Map is used purely to exclude duplicate selectors, value is unused.
+	podImages := make(map[string]bool)
+	for _, each := range podContainers {
+		if each.Image != nil && each.Image.Image != "" {
+			podImages[each.Image.Image] = true
+		}
+		if each.ImageRef != "" {
+			podImages[each.ImageRef] = true
+		}
+	}
+	containerImages := make(map[string]bool)
+	if container.Image != nil && container.Image.Image != "" {
+		containerImages[container.Image.Image] = true
+	}
+	if container.ImageRef != "" {
+		containerImages[container.ImageRef] = true
+	}
+
+	selectorValues := []string{
+		fmt.Sprintf("ns:%s", sandbox.Labels[labelPodNamespace]),
+		fmt.Sprintf("pod-uid:%s", sandbox.Labels[labelPodUID]),
+		fmt.Sprintf("pod-name:%s", sandbox.Labels[labelPodName]),
+		fmt.Sprintf("container-name:%s", container.Labels[labelContainerName]),
+		fmt.Sprintf("pod-image-count:%s", strconv.Itoa(len(podContainers))),
+	}
+	if nodeName != "" {
+		selectorValues = append(selectorValues, fmt.Sprintf("node-name:%s", nodeName))
+	}
+	if runtimeName != "" {
+		selectorValues = append(selectorValues, fmt.Sprintf("container-runtime:%s", runtimeName))
+	}
+
+	for containerImage := range containerImages {
+		selectorValues = append(selectorValues, fmt.Sprintf("container-image:%s", containerImage))
+	}
+	for podImage := range podImages {
+		selectorValues = append(selectorValues, fmt.Sprintf("pod-image:%s", podImage))
+	}
+
+	// The kubelet copies the pod labels to the sandbox, along with its own labels
+	for k, v := range sandbox.Labels {
+		if strings.HasPrefix(k, kubernetesLabelPrefix) {
+			continue
+		}
+		selectorValues = append(selectorValues, fmt.Sprintf("pod-label:%s:%s", k, v))
+	}
+
+	return selectorValues
+}
+
+// currentContainers returns the running containers of a pod, keeping the latest
+// attempt when a container was restarted. Exited attempts and init containers,
+// which exit before the other containers start, are left out.
+func currentContainers(podContainers []*runtimeapi.Container) []*runtimeapi.Container {
+	var names []string
+	latest := make(map[string]*runtimeapi.Container)
+	for _, each := range podContainers {
+		if each.State != runtimeapi.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		name := each.Labels[labelContainerName]
+		if name == "" {
+			name = each.GetMetadata().GetName()
+		}
+
+		current, ok := latest[name]
+		if !ok {
+			names = append(names, name)
+		}
+		if !ok || isLaterAttempt(each, current) {
+			latest[name] = each
+		}
+	}
+
+	containers := make([]*runtimeapi.Container, 0, len(names))
+	for _, name := range names {
+		containers = append(containers, latest[name])
+	}
+	return containers
+}
+
+// isLaterAttempt returns true when the container is a later attempt than the other one
+func isLaterAttempt(container, other *runtimeapi.Container) bool {
+	attempt, otherAttempt := container.GetMetadata().GetAttempt(), other.GetMetadata().GetAttempt()
+	if attempt != otherAttempt {
+		return attempt > otherAttempt
+	}
+	return container.CreatedAt > other.CreatedAt
+}
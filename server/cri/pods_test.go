@@ -0,0 +1,193 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/hashicorp/go-hclog"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestPodClientPodByContainerSelectors(t *testing.T) {
+	_, client := serveFixture(t)
+	c := NewPodClient(hclog.NewNullLogger(), client, "node1")
+
+	selectors, _, err := c.PodByContainer(context.Background(), webID, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(selectors)
+
+	expected := []string{
+		"container-image:mcr.microsoft.com/windows/servercore:ltsc2022",
+		"container-name:web",
+		"container-runtime:fake",
+		"node-name:node1",
+		"ns:default",
+		"pod-image-count:4",
+		"pod-image:mcr.microsoft.com/windows/nanoserver:ltsc2022",
+		"pod-image:mcr.microsoft.com/windows/servercore:ltsc2022",
+		"pod-label:app:web",
+		"pod-name:web-7c9f8d6b5-x2k4p",
+		"pod-uid:0c7a3f52-8f5e-4d38-9a8e-2f1b7c3d9e10",
+	}
+	if len(selectors) != len(expected) {
+		t.Fatalf("unexpected selectors: %v", selectors)
+	}
+	for i := range expected {
+		if selectors[i] != expected[i] {
+			t.Errorf("unexpected selector: got %q, want %q", selectors[i], expected[i])
+		}
+	}
+}
+
+func TestPodClientPodByContainerRestarted(t *testing.T) {
+	_, client := serveFixture(t)
+	c := NewPodClient(hclog.NewNullLogger(), client, "")
+
+	// The exited init container and previous attempt of the container are
+	// not part of the pod images
+	selectors, _, err := c.PodByContainer(context.Background(), hostProcessID, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var podImages []string
+	for _, selector := range selectors {
+		if strings.HasPrefix(selector, "pod-image") {
+			podImages = append(podImages, selector)
+		}
+	}
+	sort.Strings(podImages)
+
+	expected := []string{
+		"pod-image-count:1",
+		"pod-image:mcr.microsoft.com/oss/kubernetes/windows-host-process-containers-base-image:v1.0.0",
+	}
+	if !reflect.DeepEqual(podImages, expected) {
+		t.Errorf("unexpected pod image selectors: %v", podImages)
+	}
+}
+
+func TestCurrentContainers(t *testing.T) {
+	container := func(id, name string, attempt uint32, createdAt int64, state runtimeapi.ContainerState) *runtimeapi.Container {
+		return &runtimeapi.Container{
+			Id:        id,
+			Metadata:  &runtimeapi.ContainerMetadata{Name: name, Attempt: attempt},
+			State:     state,
+			CreatedAt: createdAt,
+			Labels:    map[string]string{labelContainerName: name},
+		}
+	}
+	running := runtimeapi.ContainerState_CONTAINER_RUNNING
+	exited := runtimeapi.ContainerState_CONTAINER_EXITED
+
+	containers := currentContainers([]*runtimeapi.Container{
+		container("init", "init", 0, 1, exited),
+		container("web-0", "web", 0, 2, exited),
+		// Restarted while the previous attempt was still listed as running
+		container("web-2", "web", 2, 4, running),
+		container("web-1", "web", 1, 3, running),
+		container("sidecar-a", "sidecar", 0, 5, running),
+		container("sidecar-b", "sidecar", 0, 6, running),
+		container("unknown", "unknown", 0, 7, runtimeapi.ContainerState_CONTAINER_UNKNOWN),
+	})
+
+	var ids []string
+	for _, each := range containers {
+		ids = append(ids, each.Id)
+	}
+	if expected := []string{"web-2", "sidecar-b"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("unexpected containers: got %v, want %v", ids, expected)
+	}
+}
+
+func TestPodClientPodByContainerErrors(t *testing.T) {
+	_, client := serveFixture(t)
+	c := NewPodClient(hclog.NewNullLogger(), client, "")
+	ctx := context.Background()
+
+	// The malformed-info container has no kubelet labels
+	if _, _, err := c.PodByContainer(ctx, malformedID, ""); !errors.Is(err, ErrNotKubernetesContainer) {
+		t.Errorf("expected ErrNotKubernetesContainer, got %v", err)
+	}
+	if _, _, err := c.PodByContainer(ctx, "missing", ""); err == nil {
+		t.Error("expected error for a missing container")
+	}
+}
+
+func TestPodClientPodByContainer(t *testing.T) {
+	_, client := serveFixture(t)
+	c := NewPodClient(hclog.NewNullLogger(), client, "")
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name        string
+		containerID string
+		hostProcess bool
+		expectErr   bool
+	}{
+		{name: "host process", containerID: hostProcessID, hostProcess: true},
+		{name: "process isolated", containerID: webID},
+		{name: "hyper-v isolated", containerID: hyperVID},
+		// Pod selectors are not enough when it is unknown whether the container
+		// is a HostProcess container
+		{name: "unparsable details", containerID: schemaDriftID, expectErr: true},
+		{name: "not kubernetes", containerID: malformedID, expectErr: true},
+		{name: "missing", containerID: "missing", expectErr: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			selectors, hostProcess, err := c.PodByContainer(ctx, tt.containerID, "")
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hostProcess != tt.hostProcess {
+				t.Errorf("unexpected host process: got %t, want %t", hostProcess, tt.hostProcess)
+			}
+			if !containsSelector(selectors, "container-runtime:fake") {
+				t.Errorf("missing container-runtime selector: %v", selectors)
+			}
+		})
+	}
+}
+
+func TestPodClientPodByContainerRuntime(t *testing.T) {
+	_, client := serveFixture(t)
+	c := NewPodClient(hclog.NewNullLogger(), client, "")
+	ctx := context.Background()
+
+	if _, _, err := c.PodByContainer(ctx, webID, "fake"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err := c.PodByContainer(ctx, webID, "containerd"); !errors.Is(err, process.ErrRuntimeMismatch) {
+		t.Errorf("expected ErrRuntimeMismatch, got %v", err)
+	}
+}
+
+func TestPodClientCheckRuntime(t *testing.T) {
+	_, client := serveFixture(t)
+	c := NewPodClient(hclog.NewNullLogger(), client, "")
+	if err := c.CheckRuntime(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func containsSelector(selectors []string, selector string) bool {
+	for _, each := range selectors {
+		if each == selector {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// containerInfo holds the fields used from the verbose info of a container status,
+// as reported by containerd
+type containerInfo struct {
+	SandboxID   string `json:"sandboxID"`
+	Pid         uint32 `json:"pid"`
+	Removing    bool   `json:"removing"`
+	SnapshotKey string `json:"snapshotKey"`
+	Snapshotter string `json:"snapshotter"`
+	RuntimeType string `json:"runtimeType"`
+
+	// RuntimeOptions are the options of the runtime (e.g. runhcs), their
+	// format depends on RuntimeType
+	RuntimeOptions json.RawMessage `json:"runtimeOptions"`
+
+	// Config and RuntimeSpec are parsed by deriveDetails, so that changes of
+	// their schema do not prevent the PID lookup
+	Config      json.RawMessage `json:"config"`
+	RuntimeSpec json.RawMessage `json:"runtimeSpec"`
+}
+
+// NewResolver creates a resolver that gets the status of every container of the
+// runtime on each lookup
+func NewResolver(log hclog.Logger, client runtimeapi.RuntimeServiceClient) Resolver {
+	return &resolver{
+		log:    log,
+		client: client,
+	}
+}
+
+type resolver struct {
+	log    hclog.Logger
+	client runtimeapi.RuntimeServiceClient
+}
+
+func (r *resolver) ContainerByPID(ctx context.Context, pID int32) (*Container, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "cri.ContainerByPID")
+	span.SetAttributes(telemetry.AttrPID.Int64(int64(pID)))
+	defer span.End()
+
+	// Containers without a running init process report a zero PID
+	if pID <= 0 {
+		return nil, ErrContainerNotFound
+	}
+
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, each := range resp.Containers {
+		container, err := r.containerStatus(ctx, each)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			r.log.Debug("Unable to get container status", telemetry.ContainerID, each.Id, telemetry.Error, err)
+			continue
+		}
+
+		if hostPID, ok := container.hostPID(); ok && hostPID == uint32(pID) {
+			return container, nil
+		}
+	}
+
+	return nil, ErrContainerNotFound
+}
+
+func (r *resolver) PodSandboxByID(ctx context.Context, id string) (*PodSandbox, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "cri.PodSandboxByID")
+	defer span.End()
+
+	resp, err := r.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: id})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ErrPodSandboxNotFound
+		}
+		return nil, fmt.Errorf("failed to get pod sandbox status: %w", err)
+	}
+	if resp.Status == nil {
+		return nil, ErrPodSandboxNotFound
+	}
+
+	return newPodSandbox(resp.Status), nil
+}
+
+func (r *resolver) ContainerByID(ctx context.Context, id string) (*Container, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "cri.ContainerByID")
+	span.SetAttributes(telemetry.AttrContainerID.String(id))
+	defer span.End()
+
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{Id: id},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	if len(resp.Containers) == 0 {
+		return nil, ErrContainerIDNotFound
+	}
+
+	container, err := r.containerStatus(ctx, resp.Containers[0])
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrContainerIDNotFound
+	}
+	return container, err
+}
+
+func (r *resolver) ListContainers(ctx context.Context) ([]*Container, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "cri.ListContainers")
+	defer span.End()
+
+	resp, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	containers := make([]*Container, 0, len(resp.Containers))
+	for _, each := range resp.Containers {
+		container, err := r.containerStatus(ctx, each)
+		var infoErr *infoError
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case status.Code(err) == codes.NotFound:
+			// Removed since it was listed
+			continue
+		case errors.As(err, &infoErr):
+			r.log.Debug("Unable to parse container info", telemetry.ContainerID, each.Id, telemetry.Error, err)
+			container = newContainer(each, &containerInfo{})
+		case err != nil:
+			return nil, err
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// containerStatus gets the verbose status of the container, and builds the
+// container from it
+func (r *resolver) containerStatus(ctx context.Context, c *runtimeapi.Container) (*Container, error) {
+	resp, err := r.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{
+		ContainerId: c.Id,
+		Verbose:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container status: %w", err)
+	}
+
+	info, err := parseContainerInfo(resp.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	container := newContainer(c, info)
+	if container.detailsErr != nil {
+		r.log.Debug("Unable to parse container details", telemetry.ContainerID, c.Id, telemetry.Error, container.detailsErr)
+	}
+	return container, nil
+}
+
+// infoError is returned when the verbose info of a container status is missing
+// or malformed
+type infoError struct {
+	err error
+}
+
+func (e *infoError) Error() string {
+	return e.err.Error()
+}
+
+func (e *infoError) Unwrap() error {
+	return e.err
+}
+
+// parseContainerInfo parses the "info" entry of the verbose container status
+func parseContainerInfo(verboseInfo map[string]string) (*containerInfo, error) {
+	infoStr, ok := verboseInfo["info"]
+	if !ok {
+		return nil, &infoError{err: errors.New("container status has no verbose info")}
+	}
+
+	info := new(containerInfo)
+	if err := json.Unmarshal([]byte(infoStr), info); err != nil {
+		return nil, &infoError{err: fmt.Errorf("failed to unmarshal info: %w", err)}
+	}
+	return info, nil
+}
+
+func newContainer(c *runtimeapi.Container, info *containerInfo) *Container {
+	container := &Container{
+		ID:           c.Id,
+		PodSandboxID: c.PodSandboxId,
+		PID:          info.Pid,
+		RuntimeType:  info.RuntimeType,
+		State:        c.State.String(),
+		Labels:       c.Labels,
+		Annotations:  c.Annotations,
+	}
+	if c.Metadata != nil {
+		container.Name = c.Metadata.Name
+	}
+	if c.Image != nil {
+		container.Image = c.Image.Image
+	}
+	container.detailsErr = deriveDetails(container, info)
+	return container
+}
+
+func newPodSandbox(s *runtimeapi.PodSandboxStatus) *PodSandbox {
+	sandbox := &PodSandbox{
+		ID:          s.Id,
+		Labels:      s.Labels,
+		Annotations: s.Annotations,
+	}
+	if s.Metadata != nil {
+		sandbox.Name = s.Metadata.Name
+		sandbox.Namespace = s.Metadata.Namespace
+		sandbox.UID = s.Metadata.Uid
+	}
+	sandbox.RuntimeHandler = s.RuntimeHandler
+	return sandbox
+}
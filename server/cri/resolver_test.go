@@ -0,0 +1,239 @@
+package cri
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Containers of testdata/runtime.json
+const (
+	webID          = "a1b2c3d4e5f6"
+	webPID         = 4242
+	webSandboxID   = "3f8e5a4c2b1d"
+	malformedID    = "b2c3d4e5f6a1"
+	missingPIDID   = "c3d4e5f6a1b2"
+	noInfoID       = "d4e5f6a1b2c3"
+	hostProcessID  = "e5f6a1b2c3d4"
+	hostProcessPID = 5151
+	hyperVID       = "f6a1b2c3d4e5"
+	// hyperVPID is a PID of the utility VM of the Hyper-V isolated container
+	hyperVPID = 6262
+	// schemaDriftID has a config and runtime spec that fail to parse
+	schemaDriftID  = "0a1b2c3d4e5f"
+	schemaDriftPID = 7373
+)
+
+// serveFixture serves testdata/runtime.json on a Unix socket, and returns the
+// fake and a client connected to it through the socket
+func serveFixture(t *testing.T) (*FakeRuntimeService, runtimeapi.RuntimeServiceClient) {
+	t.Helper()
+
+	f, err := LoadFakeRuntimeService(filepath.Join("testdata", "runtime.json"))
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	// Unix socket paths are short, t.TempDir includes the test name
+	dir, err := os.MkdirTemp("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "cri.sock")
+
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(f.Serve(lis))
+
+	conn, err := Dial(context.Background(), "unix://"+socketPath)
+	if err != nil {
+		t.Fatalf("failed to dial fake runtime: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return f, NewRuntimeServiceClient(conn)
+}
+
+func TestResolverContainerByPID(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewResolver(hclog.NewNullLogger(), client)
+	ctx := context.Background()
+
+	// Containers with malformed, missing or pid-less info are listed before
+	// the web container, they must not prevent the lookup
+	container, err := r.ContainerByPID(ctx, webPID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, webID, webPID)
+	if container.PodSandboxID != webSandboxID {
+		t.Errorf("unexpected pod sandbox ID %q", container.PodSandboxID)
+	}
+	if container.RuntimeType != "io.containerd.runhcs.v1" {
+		t.Errorf("unexpected runtime type %q", container.RuntimeType)
+	}
+
+	container, err = r.ContainerByPID(ctx, hostProcessPID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, hostProcessID, hostProcessPID)
+
+	// Unparsable config and runtime spec must not prevent the lookup
+	container, err = r.ContainerByPID(ctx, schemaDriftPID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, schemaDriftID, schemaDriftPID)
+	if container.Isolation != IsolationUnknown || container.SecurityContext != nil || container.detailsErr == nil {
+		t.Errorf("expected unknown details, got isolation %q, security context %+v and error %v", container.Isolation, container.SecurityContext, container.detailsErr)
+	}
+
+	// Zero PIDs of containers without init process, and utility VM PIDs of
+	// Hyper-V isolated containers, must not match host processes
+	for _, pID := range []int32{0, -1, hyperVPID, 9999} {
+		if _, err := r.ContainerByPID(ctx, pID); !errors.Is(err, ErrContainerNotFound) {
+			t.Errorf("expected ErrContainerNotFound for PID %d, got %v", pID, err)
+		}
+	}
+}
+
+func TestResolverContainerByPIDErrors(t *testing.T) {
+	f, client := serveFixture(t)
+	r := NewResolver(hclog.NewNullLogger(), client)
+	ctx := context.Background()
+
+	// Containers whose status fails are skipped
+	f.SetContainerStatusError(webID, status.Error(codes.Internal, "oh no"))
+	_, err := r.ContainerByPID(ctx, webPID)
+	if !errors.Is(err, ErrContainerNotFound) {
+		t.Errorf("expected ErrContainerNotFound, got %v", err)
+	}
+
+	f.SetListContainersError(status.Error(codes.Unavailable, "runtime down"))
+	_, err = r.ContainerByPID(ctx, webPID)
+	if status.Code(errors.Unwrap(err)) != codes.Unavailable {
+		t.Errorf("expected list error, got %v", err)
+	}
+}
+
+func TestResolverRemovedContainer(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewResolver(hclog.NewNullLogger(), client)
+	ctx := context.Background()
+
+	if _, err := client.RemoveContainer(ctx, &runtimeapi.RemoveContainerRequest{ContainerId: webID}); err != nil {
+		t.Fatalf("failed to remove container: %v", err)
+	}
+
+	_, err := r.ContainerByPID(ctx, webPID)
+	if !errors.Is(err, ErrContainerNotFound) {
+		t.Errorf("expected ErrContainerNotFound, got %v", err)
+	}
+	_, err = r.ContainerByID(ctx, webID)
+	if !errors.Is(err, ErrContainerIDNotFound) {
+		t.Errorf("expected ErrContainerIDNotFound, got %v", err)
+	}
+}
+
+func TestResolverContainerByID(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewResolver(hclog.NewNullLogger(), client)
+	ctx := context.Background()
+
+	container, err := r.ContainerByID(ctx, webID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, webID, webPID)
+
+	container, err = r.ContainerByID(ctx, missingPIDID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectContainer(t, container, missingPIDID, 0)
+
+	for _, id := range []string{malformedID, noInfoID} {
+		var infoErr *infoError
+		if _, err := r.ContainerByID(ctx, id); !errors.As(err, &infoErr) {
+			t.Errorf("expected info error for container %s, got %v", id, err)
+		}
+	}
+
+	_, err = r.ContainerByID(ctx, "missing")
+	if !errors.Is(err, ErrContainerIDNotFound) {
+		t.Errorf("expected ErrContainerIDNotFound, got %v", err)
+	}
+}
+
+func TestResolverListContainers(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewResolver(hclog.NewNullLogger(), client)
+
+	containers, err := r.ListContainers(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pIDs := make(map[string]uint32)
+	for _, container := range containers {
+		pIDs[container.ID] = container.PID
+	}
+	expected := map[string]uint32{
+		webID:         webPID,
+		malformedID:   0,
+		missingPIDID:  0,
+		noInfoID:      0,
+		hostProcessID: hostProcessPID,
+		hyperVID:      hyperVPID,
+		schemaDriftID: schemaDriftPID,
+		// Exited init container and previous attempt of the agent container
+		"a7b8c9d0e1f2": 0,
+		"b8c9d0e1f2a3": 0,
+	}
+	if len(pIDs) != len(expected) {
+		t.Fatalf("unexpected containers: %v", pIDs)
+	}
+	for id, pID := range expected {
+		if got, ok := pIDs[id]; !ok || got != pID {
+			t.Errorf("unexpected PID of container %s: got %d, want %d", id, got, pID)
+		}
+	}
+}
+
+func TestResolverPodSandboxByID(t *testing.T) {
+	_, client := serveFixture(t)
+	r := NewResolver(hclog.NewNullLogger(), client)
+	ctx := context.Background()
+
+	sandbox, err := r.PodSandboxByID(ctx, webSandboxID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sandbox.Name != "web-7c9f8d6b5-x2k4p" || sandbox.Namespace != "default" || sandbox.RuntimeHandler != "runhcs-wcow-process" {
+		t.Errorf("unexpected pod sandbox: %+v", sandbox)
+	}
+
+	_, err = r.PodSandboxByID(ctx, "missing")
+	if !errors.Is(err, ErrPodSandboxNotFound) {
+		t.Errorf("expected ErrPodSandboxNotFound, got %v", err)
+	}
+}
+
+func expectContainer(t *testing.T, container *Container, id string, pID uint32) {
+	t.Helper()
+	if container.ID != id || container.PID != pID {
+		t.Errorf("unexpected container: got %s with PID %d, want %s with PID %d", container.ID, container.PID, id, pID)
+	}
+}
@@ -0,0 +1,128 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// LivePath is the path that reports liveness
+	LivePath = "/live"
+
+	// ReadyPath is the path that reports readiness
+	ReadyPath = "/ready"
+
+	defaultCheckTimeout = 5 * time.Second
+)
+
+// Check verifies a single aspect of the server health, it returns an error
+// when the check fails.
+type Check func(ctx context.Context) error
+
+// CheckResult is the result of a single check
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the JSON body returned by the health endpoints
+type Report struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Checker keeps the liveness and readiness checks and serves them over HTTP
+type Checker struct {
+	log hclog.Logger
+
+	mtx       sync.RWMutex
+	liveness  map[string]Check
+	readiness map[string]Check
+}
+
+// NewChecker creates a Checker without checks
+func NewChecker(log hclog.Logger) *Checker {
+	return &Checker{
+		log:       log,
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+	}
+}
+
+// AddLivenessCheck adds a check reported by the /live endpoint
+func (c *Checker) AddLivenessCheck(name string, check Check) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.liveness[name] = check
+}
+
+// AddReadinessCheck adds a check reported by the /ready endpoint
+func (c *Checker) AddReadinessCheck(name string, check Check) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.readiness[name] = check
+}
+
+// Handler returns the HTTP handler that serves /live and /ready
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivePath, func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, c.liveness)
+	})
+	mux.HandleFunc(ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, c.readiness)
+	})
+	return mux
+}
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, checks map[string]Check) {
+	report := c.run(r.Context(), checks)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		c.log.Warn("Failed to write health report", telemetry.Error, err)
+	}
+}
+
+func (c *Checker) run(ctx context.Context, checks map[string]Check) Report {
+	ctx, cancel := context.WithTimeout(ctx, defaultCheckTimeout)
+	defer cancel()
+
+	c.mtx.RLock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	c.mtx.RUnlock()
+	sort.Strings(names)
+
+	report := Report{
+		OK:     true,
+		Checks: make(map[string]CheckResult, len(names)),
+	}
+	for _, name := range names {
+		c.mtx.RLock()
+		check := checks[name]
+		c.mtx.RUnlock()
+
+		result := CheckResult{OK: true}
+		if err := check(ctx); err != nil {
+			c.log.Debug("Health check failed", telemetry.Check, name, telemetry.Error, err)
+			result = CheckResult{Error: err.Error()}
+			report.OK = false
+		}
+		report.Checks[name] = result
+	}
+
+	return report
+}
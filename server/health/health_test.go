@@ -0,0 +1,113 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestCheckerHandler(t *testing.T) {
+	passing := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("oh no") }
+
+	for _, tt := range []struct {
+		name           string
+		path           string
+		liveness       map[string]Check
+		readiness      map[string]Check
+		expectedStatus int
+		expected       Report
+	}{
+		{
+			name:           "live",
+			path:           LivePath,
+			liveness:       map[string]Check{"grpc_server": passing},
+			readiness:      map[string]Check{"kubelet": failing},
+			expectedStatus: http.StatusOK,
+			expected:       Report{OK: true, Checks: map[string]CheckResult{"grpc_server": {OK: true}}},
+		},
+		{
+			name:           "not live",
+			path:           LivePath,
+			liveness:       map[string]Check{"grpc_server": failing},
+			readiness:      map[string]Check{"kubelet": passing},
+			expectedStatus: http.StatusServiceUnavailable,
+			expected:       Report{Checks: map[string]CheckResult{"grpc_server": {Error: "oh no"}}},
+		},
+		{
+			name:           "ready",
+			path:           ReadyPath,
+			readiness:      map[string]Check{"listener": passing, "kubelet": passing},
+			expectedStatus: http.StatusOK,
+			expected:       Report{OK: true, Checks: map[string]CheckResult{"listener": {OK: true}, "kubelet": {OK: true}}},
+		},
+		{
+			name:           "not ready",
+			path:           ReadyPath,
+			readiness:      map[string]Check{"listener": passing, "kubelet": failing},
+			expectedStatus: http.StatusServiceUnavailable,
+			expected:       Report{Checks: map[string]CheckResult{"listener": {OK: true}, "kubelet": {Error: "oh no"}}},
+		},
+		{
+			name:           "no checks",
+			path:           ReadyPath,
+			expectedStatus: http.StatusOK,
+			expected:       Report{OK: true, Checks: map[string]CheckResult{}},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(hclog.NewNullLogger())
+			for name, check := range tt.liveness {
+				checker.AddLivenessCheck(name, check)
+			}
+			for name, check := range tt.readiness {
+				checker.AddReadinessCheck(name, check)
+			}
+			server := httptest.NewServer(checker.Handler())
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("unexpected status: got %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("unexpected content type %q", contentType)
+			}
+			var report Report
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatalf("failed to decode report: %v", err)
+			}
+			if !reflect.DeepEqual(report, tt.expected) {
+				t.Errorf("unexpected report: got %+v, want %+v", report, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckerCheckContext(t *testing.T) {
+	checker := NewChecker(hclog.NewNullLogger())
+	checker.AddLivenessCheck("deadline", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return errors.New("check has no deadline")
+		}
+		return nil
+	})
+
+	recorder := httptest.NewRecorder()
+	checker.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, LivePath, nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status %d: %s", recorder.Code, recorder.Body)
+	}
+}
@@ -4,81 +4,348 @@ import (
 	"context"
 	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"net"
-	"syscall"
-	"unsafe"
-
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/cri"
+	"github.com/MarcosDY/npipeSample/server/health"
 	"github.com/MarcosDY/npipeSample/server/pods"
 	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
 	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
-	"github.com/zeebo/errs"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 const (
-	pipeName = `\\.\pipe\wservice`
+	// Container lookup methods
+	containerLookupJob     = "job"
+	containerLookupCRI     = "cri"
+	containerLookupCgroups = "cgroups"
+
+	// Sources of pod selectors
+	podSourceKubelet = "kubelet"
+	podSourceCRI     = "cri"
+
+	// nodeNameEnv is the environment variable with the node name, used by the cri pod source
+	nodeNameEnv = "MY_NODE_NAME"
 )
 
 var (
-	kernel32                        = syscall.NewLazyDLL("kernel32.dll")
-	getNamedPipeClientProcessIdFunc = kernel32.NewProc("GetNamedPipeClientProcessId")
-	pid                             = flag.Int("pid", 0, "")
+	pid                   = flag.Int("pid", 0, "resolve the selectors of the given process ID and exit")
+	containerRuntime      = flag.String("container-runtime", "", "expected container runtime scheme (e.g. containerd, docker) of containers whose lookup method does not report it (job), empty matches any runtime")
+	logLevel              = flag.String("log-level", "info", "log level (trace, debug, info, warn, error)")
+	logFormat             = flag.String("log-format", "text", "log format (text, json)")
+	processCacheSize      = flag.Int("process-cache-size", process.DefaultCacheSize, "maximum number of processes whose container is cached, 0 disables the cache")
+	containerLookup       = flag.String("container-lookup", defaultContainerLookup, "comma-separated methods tried in order to look up the container of a process: job (container job handles of vmcompute, Windows only), cri (container runtime), cgroups (process cgroups, Linux only)")
+	containerLookupStrict = flag.Bool("container-lookup-strict", false, "call all the container lookup methods and deny workloads they do not agree on, a host result agrees with a container one (e.g. job and cri for HostProcess containers)")
+	podSource             = flag.String("pod-source", podSourceKubelet, "source of the pod selectors: kubelet (kubelet API) or cri (container runtime labels)")
+	criEndpoint           = flag.String("cri-endpoint", "", "CRI endpoint used by the cri container lookup and pod source (e.g. npipe:////./pipe/containerd-containerd, unix:///run/containerd/containerd.sock), empty detects a well-known endpoint")
+	hostProcessPolicyName = flag.String("host-process-policy", "", "how processes of Windows HostProcess containers are attested: deny, selector (pod selectors and host-process:true) or host (host selectors). deny and selector require the cri container lookup with the job one, empty is selector when possible and host otherwise")
+	ancestryDepth         = flag.Int("ancestry-depth", 0, "number of parent processes to look up when a process is not in a container job, 0 disables the ancestry lookup")
+	discoverSHA256        = flag.Bool("discover-sha256", false, "add the SHA-256 of the executable to the selectors of host processes")
+	attestationTimeout    = flag.Duration("attestation-timeout", 10*time.Second, "maximum time to attest a workload, 0 disables the timeout")
+	healthAddr            = flag.String("health-addr", ":8080", "address to serve the /live and /ready endpoints on, empty disables health checks")
+	traceExporter         = flag.String("trace-exporter", "", "trace exporter (otlp, stdout), empty disables tracing")
+	otlpEndpoint          = flag.String("otlp-endpoint", "localhost:4317", "OTLP gRPC collector endpoint used by the otlp trace exporter")
+	metricsAddr           = flag.String("metrics-addr", ":9988", "address to serve Prometheus metrics on, empty disables metrics")
 )
 
 func main() {
-	if err := run(context.Background()); err != nil {
-		log.Fatalf("server finished: %v\n", err)
+	flag.Parse()
+
+	log, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(context.Background(), log); err != nil {
+		log.Error("Server finished", telemetry.Error, err)
+		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) (err error) {
-	flag.Parse()
+func newLogger(level, format string) (hclog.Logger, error) {
+	logLevel := hclog.LevelFromString(level)
+	if logLevel == hclog.NoLevel {
+		return nil, fmt.Errorf("unsupported log level %q", level)
+	}
+
+	var jsonFormat bool
+	switch format {
+	case "text":
+	case "json":
+		jsonFormat = true
+	default:
+		return nil, fmt.Errorf("unsupported log format %q", format)
+	}
+
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       "server",
+		Level:      logLevel,
+		JSONFormat: jsonFormat,
+	}), nil
+}
 
-	helper := process.CreateHelper()
-	log.Println(*pid)
-	cID, err := helper.GetContainerIDByProcess(int32(*pid))
+func run(ctx context.Context, log hclog.Logger) (err error) {
+	shutdownTracing, err := telemetry.SetupTracing(ctx, *traceExporter, *otlpEndpoint)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to get containerID by Process: %v", err)
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Warn("Failed to shut down tracing", telemetry.Error, err)
+		}
+	}()
+
+	metrics := telemetry.NewMetrics()
+	if *metricsAddr != "" {
+		defer serveHTTP(log, "metrics", *metricsAddr, metrics.Handler())()
+	}
+
+	lookupMethods := strings.Split(*containerLookup, ",")
+
+	// The runtime CRI endpoint is used when containers or pods are looked up through it
+	var runtimeClient runtimeapi.RuntimeServiceClient
+	if containsString(lookupMethods, containerLookupCRI) || *podSource == podSourceCRI {
+		endpoint, err := cri.ResolveEndpoint(*criEndpoint)
+		if err != nil {
+			return err
+		}
+		log.Info("Using CRI endpoint", telemetry.Address, endpoint)
+		conn, err := cri.Dial(ctx, endpoint)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		runtimeClient = cri.NewRuntimeServiceClient(conn)
 	}
-	log.Println(cID)
 
-	client, err := pods.NewClient()
+	var helpers []process.NamedHelper
+	var events containerEvents
+	for _, method := range lookupMethods {
+		var helper process.Helper
+		switch method {
+		case containerLookupJob:
+			helper, err = newJobHelper(ctx, log, metrics)
+			if err != nil {
+				return err
+			}
+		case containerLookupCRI:
+			runtimeName, err := cri.RuntimeName(ctx, runtimeClient)
+			if err != nil {
+				return err
+			}
+			resolver := cri.NewCachedResolver(log.Named("cri"), metrics, runtimeClient)
+			go func() {
+				_ = resolver.Run(ctx)
+			}()
+			helper = cri.NewHelper(log.Named("cri"), resolver, newAncestry(log), runtimeName)
+			events = resolver
+		case containerLookupCgroups:
+			if runtime.GOOS != "linux" {
+				return fmt.Errorf("container lookup %q is only supported on Linux", method)
+			}
+			helper = process.NewCgroupsHelper(log.Named("cgroups"), "/")
+		default:
+			return fmt.Errorf("unknown container lookup %q", method)
+		}
+		helpers = append(helpers, process.NamedHelper{Name: method, Helper: helper})
+	}
+	log.Info("Container lookup configured", telemetry.Resolver, *containerLookup, "strict", *containerLookupStrict)
+	helper := process.NewChainHelper(log.Named("chain"), metrics, helpers, *containerLookupStrict)
+
+	hostProcessPolicy, err := parseHostProcessPolicy(*hostProcessPolicyName, lookupMethods)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed create client: %v", err)
+		return err
+	}
+	log.Info("HostProcess policy configured", telemetry.Policy, hostProcessPolicy)
+
+	var podClient podLookup
+	var podSourceCheck health.Check
+	switch *podSource {
+	case podSourceKubelet:
+		client, err := pods.NewClient(log.Named("pods"), metrics)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed create client: %v", err)
+		}
+		podClient, podSourceCheck = client, client.CheckKubelet
+	case podSourceCRI:
+		client := cri.NewPodClient(log.Named("pods"), runtimeClient, os.Getenv(nodeNameEnv))
+		podClient, podSourceCheck = client, client.CheckRuntime
+	default:
+		return fmt.Errorf("unknown pod source %q", *podSource)
+	}
+
+	attestor := &attestor{
+		log:       log.Named("attestor"),
+		helper:    helper,
+		inspector: newInspector(log.Named("process"), *discoverSHA256),
+		pods:      podClient,
+
+		hostProcessPolicy: hostProcessPolicy,
+		containerRuntime:  *containerRuntime,
+		timeout:           *attestationTimeout,
 	}
 
-	s, err := client.GetPodByContainer(cID)
+	// When a PID is provided, resolve its selectors and exit
+	if *pid != 0 {
+		return lookup(ctx, log, attestor, int32(*pid))
+	}
+
+	// Set to 1 while the listener is bound
+	var listening int32
+
+	checker := health.NewChecker(log.Named("health"))
+	checker.AddLivenessCheck("grpc_server", grpcServingCheck(dialListener))
+	checker.AddReadinessCheck("listener", func(context.Context) error {
+		if atomic.LoadInt32(&listening) == 0 {
+			return fmt.Errorf("listener is not bound to %s", listenAddress)
+		}
+		return nil
+	})
+	checker.AddReadinessCheck(*podSource, podSourceCheck)
+	// There is no CA or signing key check, the served SVIDs only carry the
+	// SPIFFE ID and no key material is loaded.
+	if *healthAddr != "" {
+		defer serveHTTP(log, "health", *healthAddr, checker.Handler())()
+	}
+
+	listener, err := listen()
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to get pod container: %v", err)
+		return err
 	}
-	for i, ss := range s {
-		log.Printf("%v - %q\n", i, ss)
+	defer listener.Close()
+	atomic.StoreInt32(&listening, 1)
+	defer atomic.StoreInt32(&listening, 0)
+
+	server := grpc.NewServer(
+		grpc.Creds(new(TransportCredentials)),
+		grpc.StreamInterceptor(metrics.StreamServerInterceptor()),
+		grpc.UnaryInterceptor(metrics.UnaryServerInterceptor()),
+	)
+	grpc_health_v1.RegisterHealthServer(server, grpchealth.NewServer())
+	workload.RegisterSpiffeWorkloadAPIServer(server, &Server{
+		log:      log,
+		metrics:  metrics,
+		attestor: attestor,
+		events:   events,
+	})
+	log.Info("Listening", telemetry.Address, listenAddress)
+	return server.Serve(listener)
+}
+
+// containsString returns true when the value is in the list
+func containsString(list []string, value string) bool {
+	for _, each := range list {
+		if each == value {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// serveHTTP serves the handler on the given address in the background,
+// it returns a function that stops the server.
+func serveHTTP(log hclog.Logger, name, addr string, handler http.Handler) func() {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	go func() {
+		log.Info("Serving "+name, telemetry.Address, addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("HTTP server failed", telemetry.Address, addr, telemetry.Error, err)
+		}
+	}()
+	return func() {
+		server.Close()
+	}
+}
+
+// grpcServingCheck returns a check that calls the gRPC health service through
+// the given dialer, it fails unless the server accepts the connection and
+// reports that it is serving.
+func grpcServingCheck(dial func(ctx context.Context) (net.Conn, error)) health.Check {
+	return func(ctx context.Context) error {
+		conn, err := grpc.DialContext(ctx, "passthrough:///"+listenAddress,
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return dial(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithBlock(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the gRPC server: %w", err)
+		}
+		defer conn.Close()
+
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			return fmt.Errorf("gRPC health check failed: %w", err)
+		}
+		if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("gRPC server is %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+func lookup(ctx context.Context, log hclog.Logger, attestor *attestor, pID int32) error {
+	result, selectors, err := attestor.Attest(ctx, pID)
+	if err != nil {
+		return err
+	}
+	log.Info("Process attested", telemetry.PID, pID, telemetry.Location, result.Location.String(), telemetry.ContainerID, result.ContainerID, telemetry.Resolver, result.Resolver)
+	for _, selector := range selectors {
+		log.Info("Selector", telemetry.Selector, selector)
+	}
 
-	// listener, err := winio.ListenPipe(pipeName, nil)
-	// if err != nil {
-	// return errs.Wrap(err)
-	// }
-	// defer listener.Close()
+	return nil
+}
 
-	// server := grpc.NewServer(grpc.Creds(new(TransportCredentials)))
-	// workload.RegisterSpiffeWorkloadAPIServer(server, &Server{})
-	// log.Printf("Listening on %s", pipeName)
-	// return server.Serve(listener)
+// containerEvents notifies when containers stop running
+type containerEvents interface {
+	Subscribe() *cri.Subscription
 }
 
 type Server struct {
 	workload.SpiffeWorkloadAPIServer
+
+	log      hclog.Logger
+	metrics  *telemetry.Metrics
+	attestor *attestor
+	// events is nil when the container lookup can not notify stopped containers,
+	// then the stream is closed once the identity is sent
+	events containerEvents
 }
 
-func (s *Server) FetchX509SVID(req *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
-	ctx := stream.Context()
+func (s *Server) FetchX509SVID(req *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) (err error) {
+	ctx, span := telemetry.Tracer().Start(stream.Context(), "FetchX509SVID")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+		span.End()
+	}()
 
 	p, ok := peer.FromContext(ctx)
 	if !ok {
@@ -89,27 +356,77 @@ func (s *Server) FetchX509SVID(req *workload.X509SVIDRequest, stream workload.Sp
 		return status.Errorf(codes.Internal, "unexpected pipe info: %T", p.AuthInfo)
 	}
 
-	pID, err := getProcessId(authInfo.PHandle())
-	if err != nil {
-		return status.Errorf(codes.Internal, "failed to get PID: %v", err)
-	}
+	pID := authInfo.PID()
+	span.SetAttributes(telemetry.AttrPID.Int64(int64(pID)))
 
-	log.Printf("ProcessID: %d\n", pID)
+	s.log.Debug("Attesting workload", telemetry.PID, pID)
 
-	helper := process.CreateHelper()
+	// Subscribe before attesting, to not miss the container stopping in between
+	var sub *cri.Subscription
+	if s.events != nil {
+		sub = s.events.Subscribe()
+		defer sub.Close()
+	}
 
-	cID, err := helper.GetContainerIDByProcess(int32(pID))
+	start := time.Now()
+	result, selectors, err := s.attestor.Attest(ctx, pID)
+	s.metrics.ObserveAttestation(err, time.Since(start))
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to get containerID by Process: %v", err)
+		return err
+	}
+
+	// The caller was tracked when it connected, detect that it exited and its
+	// PID was reused by another process while the selectors were computed
+	if err := authInfo.Caller().Verify(); err != nil {
+		if errors.Is(err, process.ErrCallerChanged) {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return status.Errorf(codes.Internal, "failed to verify caller process: %v", err)
+	}
+	span.SetAttributes(telemetry.AttrContainerID.String(result.ContainerID))
+	span.SetAttributes(telemetry.AttrResolver.String(result.Resolver))
+	s.log.Debug("Workload attested", telemetry.PID, pID, telemetry.Location, result.Location.String(), telemetry.ContainerID, result.ContainerID, telemetry.Resolver, result.Resolver, telemetry.Count, len(selectors))
+
+	// Processes on the host have no container ID
+	spiffeID := result.ContainerID
+	if result.Location == process.LocationHost {
+		spiffeID = result.Location.String()
 	}
 
-	return stream.Send(&workload.X509SVIDResponse{
+	if err := stream.Send(&workload.X509SVIDResponse{
 		Svids: []*workload.X509SVID{
 			{
-				SpiffeId: cID,
+				SpiffeId: spiffeID,
 			},
 		},
-	})
+	}); err != nil {
+		return err
+	}
+
+	if sub == nil || result.Location != process.LocationContainer {
+		return nil
+	}
+	return s.waitContainerStopped(ctx, sub, result.ContainerID)
+}
+
+// waitContainerStopped keeps the stream open until the container stops, then the
+// identity is revoked by closing the stream with an error
+func (s *Server) waitContainerStopped(ctx context.Context, sub *cri.Subscription, containerID string) error {
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Events were dropped, the workload must attest again
+				return status.Error(codes.Unavailable, "container events lost, reconnect to attest again")
+			}
+			if event.ContainerID == containerID {
+				s.log.Info("Revoking identity of stopped container", telemetry.ContainerID, containerID)
+				return status.Errorf(codes.PermissionDenied, "container %s stopped", containerID)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
 
 type TransportCredentials struct {
@@ -120,16 +437,21 @@ func (c *TransportCredentials) ClientHandshake(context.Context, string, net.Conn
 }
 
 func (c *TransportCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
-	type Fder interface {
-		Fd() uintptr
+	// The connection time is taken before the PID is read, a process that
+	// reused the PID of an exited caller started after it
+	connectedAt := time.Now()
+	pID, err := peerPID(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to get PID: %w", err)
 	}
-	fder, ok := conn.(Fder)
-	if !ok {
+	caller, err := openCaller(pID, connectedAt)
+	if err != nil {
 		conn.Close()
-		return nil, nil, errors.New("invalid conenction")
+		return nil, nil, fmt.Errorf("failed to track caller process: %w", err)
 	}
 
-	return conn, newPipeAuthInfo(fder.Fd()), nil
+	return &callerConn{Conn: conn, caller: caller}, newPipeAuthInfo(pID, caller), nil
 }
 
 func (c *TransportCredentials) Info() credentials.ProtocolInfo {
@@ -151,12 +473,14 @@ func (c *TransportCredentials) OverrideServerName(string) error {
 
 // TODO: it must be implemented from peertracker
 type PipeAuthInfo struct {
-	pHandle uintptr
+	pID    int32
+	caller process.Caller
 }
 
-func newPipeAuthInfo(pHandle uintptr) *PipeAuthInfo {
+func newPipeAuthInfo(pID int32, caller process.Caller) *PipeAuthInfo {
 	return &PipeAuthInfo{
-		pHandle: pHandle,
+		pID:    pID,
+		caller: caller,
 	}
 }
 
@@ -164,15 +488,25 @@ func (p *PipeAuthInfo) AuthType() string {
 	return "pipe"
 }
 
-func (p *PipeAuthInfo) PHandle() uintptr {
-	return p.pHandle
+func (p *PipeAuthInfo) PID() int32 {
+	return p.pID
 }
 
-func getProcessId(pHandle uintptr) (uint32, error) {
-	var pid uint32
-	r1, _, err := getNamedPipeClientProcessIdFunc.Call(pHandle, uintptr(unsafe.Pointer(&pid)))
-	if r1 == 0 {
-		return 0, errs.New("GetNamedPipeClientProcessId: %v", err)
-	}
-	return pid, nil
+// Caller tracks the process that opened the connection
+func (p *PipeAuthInfo) Caller() process.Caller {
+	return p.caller
+}
+
+// callerConn releases the caller tracking when the connection is closed
+type callerConn struct {
+	net.Conn
+	caller    process.Caller
+	closeOnce sync.Once
+}
+
+func (c *callerConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.caller.Close()
+	})
+	return c.Conn.Close()
 }
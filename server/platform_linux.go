@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// listenAddress is the Unix socket the Workload API is served on
+	listenAddress = "/run/wservice.sock"
+
+	defaultContainerLookup = containerLookupCgroups
+
+	// rootDir is where procfs and the user and group databases are read from
+	rootDir = "/"
+)
+
+func listen() (net.Listener, error) {
+	// Remove the socket left by a previous run
+	if err := os.Remove(listenAddress); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove socket: %w", err)
+	}
+	listener, err := net.Listen("unix", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	// Any workload must be able to connect, they are told apart by attestation
+	if err := os.Chmod(listenAddress, 0o777); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// dialListener connects to the Workload API socket
+func dialListener(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", listenAddress)
+}
+
+// peerPID returns the PID of the client of a Unix socket connection, from its
+// credentials
+func peerPID(conn net.Conn) (int32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("unexpected connection type %T", conn)
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var ucred *unix.Ucred
+	var ucredErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if ucredErr != nil {
+		return 0, fmt.Errorf("failed to get peer credentials: %w", ucredErr)
+	}
+	return ucred.Pid, nil
+}
+
+func newInspector(log hclog.Logger, discoverSHA256 bool) process.Inspector {
+	return process.NewUnixInspector(log, rootDir, discoverSHA256)
+}
+
+func newAncestry(hclog.Logger) process.Ancestry {
+	return process.NewUnixAncestry(rootDir)
+}
+
+func openCaller(pID int32, connectedAt time.Time) (process.Caller, error) {
+	return process.NewUnixCaller(rootDir, pID, connectedAt)
+}
+
+// newJobHelper fails, container jobs only exist on Windows
+func newJobHelper(context.Context, hclog.Logger, *telemetry.Metrics) (process.Helper, error) {
+	return nil, fmt.Errorf("container lookup %q is only supported on Windows", containerLookupJob)
+}
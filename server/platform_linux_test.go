@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// connectUnix returns the server side of a Unix socket connection opened by
+// this process
+func connectUnix(t *testing.T) net.Conn {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	client, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestPeerPID(t *testing.T) {
+	pID, err := peerPID(connectUnix(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if int(pID) != os.Getpid() {
+		t.Errorf("unexpected peer PID: got %d, want %d", pID, os.Getpid())
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	conn, authInfo, err := new(TransportCredentials).ServerHandshake(connectUnix(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	pipeAuthInfo, ok := authInfo.(*PipeAuthInfo)
+	if !ok {
+		t.Fatalf("unexpected auth info %T", authInfo)
+	}
+	if int(pipeAuthInfo.PID()) != os.Getpid() {
+		t.Errorf("unexpected PID: got %d, want %d", pipeAuthInfo.PID(), os.Getpid())
+	}
+	if err := pipeAuthInfo.Caller().Verify(); err != nil {
+		t.Errorf("unexpected caller error: %v", err)
+	}
+}
+
+func TestGRPCServingCheck(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthServer := grpchealth.NewServer()
+	server := grpc.NewServer(grpc.Creds(new(TransportCredentials)))
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	check := grpcServingCheck(func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socketPath)
+	})
+	run := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return check(ctx)
+	}
+
+	if err := run(); err != nil {
+		t.Errorf("unexpected error while serving: %v", err)
+	}
+
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	if err := run(); err == nil {
+		t.Error("expected error while not serving")
+	}
+
+	server.Stop()
+	if err := run(); err == nil {
+		t.Error("expected error after the server stopped")
+	}
+}
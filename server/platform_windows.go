@@ -0,0 +1,88 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/Microsoft/go-winio"
+	"github.com/hashicorp/go-hclog"
+	"github.com/zeebo/errs"
+)
+
+const (
+	// listenAddress is the named pipe the Workload API is served on
+	listenAddress = `\\.\pipe\wservice`
+
+	defaultContainerLookup = containerLookupJob
+)
+
+var (
+	kernel32                        = syscall.NewLazyDLL("kernel32.dll")
+	getNamedPipeClientProcessIdFunc = kernel32.NewProc("GetNamedPipeClientProcessId")
+)
+
+func listen() (net.Listener, error) {
+	listener, err := winio.ListenPipe(listenAddress, nil)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return listener, nil
+}
+
+// dialListener connects to the Workload API named pipe
+func dialListener(ctx context.Context) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, listenAddress)
+}
+
+// peerPID returns the PID of the client of a named pipe connection
+func peerPID(conn net.Conn) (int32, error) {
+	type Fder interface {
+		Fd() uintptr
+	}
+	fder, ok := conn.(Fder)
+	if !ok {
+		return 0, fmt.Errorf("unexpected connection type %T", conn)
+	}
+
+	var pid uint32
+	r1, _, err := getNamedPipeClientProcessIdFunc.Call(fder.Fd(), uintptr(unsafe.Pointer(&pid)))
+	if r1 == 0 {
+		return 0, errs.New("GetNamedPipeClientProcessId: %v", err)
+	}
+	return int32(pid), nil
+}
+
+func newInspector(log hclog.Logger, discoverSHA256 bool) process.Inspector {
+	return process.CreateWindowsInspector(log, discoverSHA256)
+}
+
+func newAncestry(log hclog.Logger) process.Ancestry {
+	return process.CreateWindowsAncestry(log.Named("process"))
+}
+
+func openCaller(pID int32, connectedAt time.Time) (process.Caller, error) {
+	return process.OpenCaller(pID, connectedAt)
+}
+
+// newJobHelper creates a helper that looks up containers through the container
+// jobs of vmcompute, cached when a cache size is configured
+func newJobHelper(ctx context.Context, log hclog.Logger, metrics *telemetry.Metrics) (process.Helper, error) {
+	if *processCacheSize <= 0 {
+		return process.CreateHelper(log.Named("process"), metrics, *ancestryDepth), nil
+	}
+
+	cachedHelper := process.CreateCachedHelper(log.Named("process"), metrics, *processCacheSize, *ancestryDepth)
+	go func() {
+		_ = cachedHelper.Run(ctx)
+	}()
+	return cachedHelper, nil
+}
@@ -1,13 +1,13 @@
 package pods
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,8 +15,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
 	"github.com/spiffe/spire/pkg/agent/common/cgroups"
 	"github.com/spiffe/spire/pkg/common/pemutil"
+	otelcodes "go.opentelemetry.io/otel/codes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
@@ -97,13 +101,15 @@ func readFile(path string) ([]byte, error) {
 	return io.ReadAll(f)
 }
 
-func NewClient() (*Client, error) {
+// NewClient creates a kubelet client for the node named by the MY_NODE_NAME
+// environment variable, or the local kubelet when it is not set.
+func NewClient(log hclog.Logger, metrics *telemetry.Metrics) (*Client, error) {
 	mountPoint := os.Getenv(defaultContainerMountPoint)
 
 	config := &k8sConfig{
 		Port:                    defaultSecureKubeletPort,
 		TokenPath:               mountPoint + defaultTokenPath,
-		NodeName:                "winw1",
+		NodeName:                os.Getenv(defaultNodeNameEnv),
 		SkipKubeletVerification: true,
 	}
 	// // The insecure client only needs to be loaded once.
@@ -195,42 +201,77 @@ func NewClient() (*Client, error) {
 			Scheme: "https",
 			Host:   fmt.Sprintf("%s:%d", host, config.Port),
 		},
-		Token: token,
+		Token:   token,
+		Metrics: metrics,
 	}
 	// config.LastReload = p.clock.Now()
 
 	return &Client{
-		c: config,
+		c:   config,
+		log: log,
 	}, nil
 }
 
 type Client struct {
-	c *k8sConfig
+	c   *k8sConfig
+	log hclog.Logger
 }
 
-func (c *Client) GetPodByContainer(containerID string) ([]string, error) {
-	list, err := c.c.Client.GetPodList()
+// PodByContainer returns the pod selectors of the container, and whether it
+// runs as a Windows HostProcess container according to the security context of
+// its pod spec. Both come from the same pod list. When expectedRuntime is set,
+// containers reported with another runtime scheme fail with
+// process.ErrRuntimeMismatch.
+func (c *Client) PodByContainer(ctx context.Context, containerID, expectedRuntime string) ([]string, bool, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "pods.PodByContainer")
+	defer span.End()
+	span.SetAttributes(telemetry.AttrContainerID.String(containerID))
+
+	pod, status, runtime, err := c.findContainer(ctx, containerID, expectedRuntime)
 	if err != nil {
-		return nil, err
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+		return nil, false, err
+	}
+	span.SetAttributes(telemetry.AttrPodUID.String(string(pod.UID)))
+
+	_, selectorsSpan := telemetry.Tracer().Start(ctx, "pods.getSelectorValuesFromPodInfo")
+	defer selectorsSpan.End()
+	return getSelectorValuesFromPodInfo(pod, status, runtime), isHostProcess(pod, status.Name), nil
+}
+
+// findContainer returns the pod and status of the container, and its runtime
+// scheme, which must be expectedRuntime when it is set
+func (c *Client) findContainer(ctx context.Context, containerID, expectedRuntime string) (*corev1.Pod, *corev1.ContainerStatus, string, error) {
+	list, err := c.c.Client.GetPodList(ctx)
+	if err != nil {
+		return nil, nil, "", err
 	}
 
-	for _, item := range list.Items {
-		item := item
-		log.Println("----------------------------------------------")
-		log.Printf("%+v\n", item)
-		log.Println("----------------------------------------------")
+	c.log.Debug("Searching container in pods", telemetry.ContainerID, containerID, telemetry.Count, len(list.Items))
+	for i := range list.Items {
+		item := &list.Items[i]
 		// if item.UID != podUID {
 		// continue
 		// }
 
-		status, lookup := lookUpContainerInPod(containerID, item.Status)
+		status, runtime, lookup := lookUpContainerInPod(containerID, item.Status)
 		switch lookup {
 		case containerInPod:
-			return getSelectorValuesFromPodInfo(&item, status), nil
+			c.log.Debug("Container found in pod", telemetry.ContainerID, containerID, telemetry.ContainerRuntime, runtime, telemetry.PodUID, item.UID, telemetry.PodName, item.Name)
+			if expectedRuntime != "" && runtime != expectedRuntime {
+				return nil, nil, "", fmt.Errorf("%w: container %q found with runtime %q, expected %q", process.ErrRuntimeMismatch, containerID, runtime, expectedRuntime)
+			}
+			return item, status, runtime, nil
 		case containerNotInPod:
 		}
 	}
-	return nil, errors.New("not found")
+	return nil, nil, "", errors.New("not found")
+}
+
+// CheckKubelet verifies the kubelet API is reachable
+func (c *Client) CheckKubelet(ctx context.Context) error {
+	return c.c.Client.Healthz(ctx)
 }
 
 func getPodImageIdentifiers(containerStatusArray []corev1.ContainerStatus) map[string]bool {
@@ -251,7 +292,7 @@ func getPodImageIdentifiers(containerStatusArray []corev1.ContainerStatus) map[s
 	return podImages
 }
 
-func getSelectorValuesFromPodInfo(pod *corev1.Pod, status *corev1.ContainerStatus) []string {
+func getSelectorValuesFromPodInfo(pod *corev1.Pod, status *corev1.ContainerStatus, runtime string) []string {
 	podImageIdentifiers := getPodImageIdentifiers(pod.Status.ContainerStatuses)
 	podInitImageIdentifiers := getPodImageIdentifiers(pod.Status.InitContainerStatuses)
 	containerImageIdentifiers := getPodImageIdentifiers([]corev1.ContainerStatus{*status})
@@ -263,6 +304,7 @@ func getSelectorValuesFromPodInfo(pod *corev1.Pod, status *corev1.ContainerStatu
 		fmt.Sprintf("pod-uid:%s", pod.UID),
 		fmt.Sprintf("pod-name:%s", pod.Name),
 		fmt.Sprintf("container-name:%s", status.Name),
+		fmt.Sprintf("container-runtime:%s", runtime),
 		fmt.Sprintf("pod-image-count:%s", strconv.Itoa(len(pod.Status.ContainerStatuses))),
 		fmt.Sprintf("pod-init-image-count:%s", strconv.Itoa(len(pod.Status.InitContainerStatuses))),
 	}
@@ -292,12 +334,16 @@ type kubeletClient struct {
 	Transport *http.Transport
 	URL       url.URL
 	Token     string
+	Metrics   *telemetry.Metrics
 }
 
-func (c *kubeletClient) GetPodList() (*corev1.PodList, error) {
+func (c *kubeletClient) GetPodList(ctx context.Context) (*corev1.PodList, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "kubelet.GetPodList")
+	defer span.End()
+
 	url := c.URL
 	url.Path = "/pods"
-	req, err := http.NewRequest("GET", url.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "unable to create request: %v", err)
 	}
@@ -309,11 +355,14 @@ func (c *kubeletClient) GetPodList() (*corev1.PodList, error) {
 	if c.Transport != nil {
 		client.Transport = c.Transport
 	}
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		c.Metrics.ObserveKubeletRequest("error", time.Since(start))
 		return nil, status.Errorf(codes.Internal, "unable to perform request: %v", err)
 	}
 	defer resp.Body.Close()
+	c.Metrics.ObserveKubeletRequest(strconv.Itoa(resp.StatusCode), time.Since(start))
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, status.Errorf(codes.Internal, "unexpected status code on pods response: %d %s", resp.StatusCode, tryRead(resp.Body))
@@ -327,50 +376,97 @@ func (c *kubeletClient) GetPodList() (*corev1.PodList, error) {
 	return out, nil
 }
 
+// Healthz calls the kubelet /healthz endpoint
+func (c *kubeletClient) Healthz(ctx context.Context) error {
+	url := c.URL
+	url.Path = "/healthz"
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return status.Errorf(codes.Internal, "unable to create request: %v", err)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := &http.Client{}
+	if c.Transport != nil {
+		client.Transport = c.Transport
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "unable to perform request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return status.Errorf(codes.Unavailable, "unexpected status code on healthz response: %d %s", resp.StatusCode, tryRead(resp.Body))
+	}
+
+	return nil
+}
+
 func tryRead(r io.Reader) string {
 	buf := make([]byte, 1024)
 	n, _ := r.Read(buf)
 	return string(buf[:n])
 }
 
-func lookUpContainerInPod(containerID string, status corev1.PodStatus) (*corev1.ContainerStatus, containerLookup) {
-	for _, status := range status.ContainerStatuses {
-		// TODO: should we be keying off of the status or is the lack of a
-		// container id sufficient to know the container is not ready?
-		if status.ContainerID == "" {
-			continue
+// lookUpContainerInPod searches the pod status for a container with the provided ID.
+// Container IDs are reported as `<runtime>://<id>` (e.g. `containerd://...`,
+// `docker://...`), the runtime scheme is returned alongside the status.
+func lookUpContainerInPod(containerID string, status corev1.PodStatus) (*corev1.ContainerStatus, string, containerLookup) {
+	for _, statuses := range [][]corev1.ContainerStatus{status.ContainerStatuses, status.InitContainerStatuses} {
+		for i := range statuses {
+			// TODO: should we be keying off of the status or is the lack of a
+			// container id sufficient to know the container is not ready?
+			if statuses[i].ContainerID == "" {
+				continue
+			}
+
+			runtime, id := parseContainerID(statuses[i].ContainerID)
+			if containerID == id {
+				return &statuses[i], runtime, containerInPod
+			}
 		}
+	}
 
-		containerURL, err := url.Parse(status.ContainerID)
-		if err != nil {
-			log.Printf("Malformed container id %q: %v", status.ContainerID, err)
-			continue
-		}
+	return nil, "", containerNotInPod
+}
 
-		if containerID == containerURL.Host {
-			return &status, containerInPod
-		}
+// parseContainerID splits a container ID of a pod status into its runtime
+// scheme and the ID the runtime knows. The runtime is empty when the ID has no
+// scheme.
+func parseContainerID(containerID string) (runtime, id string) {
+	if i := strings.Index(containerID, "://"); i >= 0 {
+		return containerID[:i], containerID[i+len("://"):]
 	}
+	return "", containerID
+}
 
-	for _, status := range status.InitContainerStatuses {
-		// TODO: should we be keying off of the status or is the lack of a
-		// container id sufficient to know the container is not ready?
-		if status.ContainerID == "" {
-			continue
-		}
-
-		containerURL, err := url.Parse(status.ContainerID)
-		if err != nil {
-			log.Printf("Malformed container id %q: %v", status.ContainerID, err)
-			continue
-		}
+// isHostProcess returns the hostProcess option of the Windows security context
+// of the container, or of the pod when the container does not set it
+func isHostProcess(pod *corev1.Pod, containerName string) bool {
+	hostProcess := false
+	if pod.Spec.SecurityContext != nil {
+		hostProcess = hostProcessOption(pod.Spec.SecurityContext.WindowsOptions, hostProcess)
+	}
 
-		if containerID == containerURL.Host {
-			return &status, containerInPod
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			if container.Name == containerName && container.SecurityContext != nil {
+				return hostProcessOption(container.SecurityContext.WindowsOptions, hostProcess)
+			}
 		}
 	}
+	return hostProcess
+}
 
-	return nil, containerNotInPod
+// hostProcessOption returns the hostProcess option, or defaultValue when it is not set
+func hostProcessOption(options *corev1.WindowsSecurityContextOptions, defaultValue bool) bool {
+	if options == nil || options.HostProcess == nil {
+		return defaultValue
+	}
+	return *options.HostProcess
 }
 
 func newCertPool(certs []*x509.Certificate) *x509.CertPool {
@@ -0,0 +1,241 @@
+package pods
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/process"
+	"github.com/hashicorp/go-hclog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseContainerID(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		containerID string
+		runtime     string
+		id          string
+	}{
+		{name: "docker", containerID: "docker://a1b2c3d4e5f6", runtime: "docker", id: "a1b2c3d4e5f6"},
+		{name: "containerd", containerID: "containerd://a1b2c3d4e5f6", runtime: "containerd", id: "a1b2c3d4e5f6"},
+		{name: "cri-o", containerID: "cri-o://a1b2c3d4e5f6", runtime: "cri-o", id: "a1b2c3d4e5f6"},
+		{name: "no scheme", containerID: "a1b2c3d4e5f6", id: "a1b2c3d4e5f6"},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			runtime, id := parseContainerID(tt.containerID)
+			if runtime != tt.runtime || id != tt.id {
+				t.Errorf("unexpected runtime %q and ID %q, want %q and %q", runtime, id, tt.runtime, tt.id)
+			}
+		})
+	}
+}
+
+func TestLookUpContainerInPod(t *testing.T) {
+	status := corev1.PodStatus{
+		InitContainerStatuses: []corev1.ContainerStatus{
+			{Name: "init", ContainerID: "containerd://init1"},
+		},
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "waiting"},
+			{Name: "web", ContainerID: "docker://web1"},
+			{Name: "plain", ContainerID: "plain1"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name        string
+		containerID string
+		status      string
+		runtime     string
+		lookup      containerLookup
+	}{
+		{name: "container", containerID: "web1", status: "web", runtime: "docker", lookup: containerInPod},
+		{name: "init container", containerID: "init1", status: "init", runtime: "containerd", lookup: containerInPod},
+		{name: "no scheme", containerID: "plain1", status: "plain", lookup: containerInPod},
+		// The scheme is not part of the ID
+		{name: "scheme only", containerID: "docker", lookup: containerNotInPod},
+		{name: "missing", containerID: "missing", lookup: containerNotInPod},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			found, runtime, lookup := lookUpContainerInPod(tt.containerID, status)
+			if lookup != tt.lookup {
+				t.Fatalf("unexpected lookup result %d", lookup)
+			}
+			if lookup == containerNotInPod {
+				return
+			}
+			if found.Name != tt.status || runtime != tt.runtime {
+				t.Errorf("unexpected container %q with runtime %q", found.Name, runtime)
+			}
+		})
+	}
+}
+
+func TestClientPodByContainer(t *testing.T) {
+	hostProcess := true
+	podList := corev1.PodList{Items: []corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-web"},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "web", ContainerID: "containerd://web1", Image: "web:1"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "kube-system", UID: "uid-agent"},
+			Spec: corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{
+				WindowsOptions: &corev1.WindowsSecurityContextOptions{HostProcess: &hostProcess},
+			}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "agent", ContainerID: "containerd://agent1", Image: "agent:1"},
+			}},
+		},
+	}}
+	var podRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		podRequests++
+		_ = json.NewEncoder(w).Encode(podList)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{
+		c:   &k8sConfig{Client: &kubeletClient{URL: *serverURL}},
+		log: hclog.NewNullLogger(),
+	}
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name            string
+		containerID     string
+		expectedRuntime string
+		hostProcess     bool
+		expectErr       error
+	}{
+		{name: "any runtime", containerID: "web1"},
+		{name: "expected runtime", containerID: "web1", expectedRuntime: "containerd"},
+		{name: "host process", containerID: "agent1", hostProcess: true},
+		{name: "runtime mismatch", containerID: "web1", expectedRuntime: "docker", expectErr: process.ErrRuntimeMismatch},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			podRequests = 0
+			selectors, hostProcess, err := c.PodByContainer(ctx, tt.containerID, tt.expectedRuntime)
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) {
+					t.Fatalf("expected %v, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hostProcess != tt.hostProcess {
+				t.Errorf("unexpected host process: got %t, want %t", hostProcess, tt.hostProcess)
+			}
+			if !containsSelector(selectors, "container-runtime:containerd") {
+				t.Errorf("missing container-runtime selector: %v", selectors)
+			}
+			if podRequests != 1 {
+				t.Errorf("expected one pod list request, got %d", podRequests)
+			}
+		})
+	}
+
+	if _, _, err := c.PodByContainer(ctx, "missing", ""); err == nil {
+		t.Error("expected error for a missing container")
+	}
+}
+
+func TestNewClientNodeName(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		nodeName string
+		host     string
+	}{
+		{name: "node name", nodeName: "node1", host: "node1:10250"},
+		{name: "local kubelet", host: "127.0.0.1:10250"},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(defaultContainerMountPoint, writeServiceAccount(t))
+			t.Setenv(defaultNodeNameEnv, tt.nodeName)
+
+			c, err := NewClient(hclog.NewNullLogger(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.c.NodeName != tt.nodeName || c.c.Client.URL.Host != tt.host {
+				t.Errorf("unexpected node name %q and kubelet host %q", c.c.NodeName, c.c.Client.URL.Host)
+			}
+		})
+	}
+}
+
+// writeServiceAccount writes the service account token and kubelet CA under a
+// mount point, and returns it
+func writeServiceAccount(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kubelet-ca"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountPoint := t.TempDir()
+	for path, content := range map[string][]byte{
+		defaultTokenPath:     []byte("token\n"),
+		defaultKubeletCAPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	} {
+		path = filepath.Join(mountPoint, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mountPoint
+}
+
+func containsSelector(selectors []string, selector string) bool {
+	for _, each := range selectors {
+		if each == selector {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package process
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Ancestry lists the ancestors of processes
+type Ancestry interface {
+	// Ancestors returns the IDs of the ancestors of the process, its parent
+	// first. The list ends at a parent that exited, or whose ID was reused by
+	// a process created after its child.
+	Ancestors(ctx context.Context, pID int32) ([]int32, error)
+}
+
+// NewWindowsAncestry creates an Ancestry that lists the processes through the
+// provided API
+func NewWindowsAncestry(log hclog.Logger, wapi API) Ancestry {
+	return &helper{
+		log:   log,
+		wapi:  wapi,
+		index: newJobIndex(),
+	}
+}
+
+// ancestorMatch is the container job of the closest ancestor assigned to one
+type ancestorMatch struct {
+	pID      int32
+	depth    int
+	jobNames []string
+}
+
+// matchAncestors walks up the parents of the process, at most h.ancestryDepth
+// levels, and returns the container jobs of the first ancestor assigned to
+// any. Processes started with runas or with a breakaway-from-job flag are not
+// assigned to the container job, but one of their ancestors is.
+// A nil match is returned when no ancestor is in a container job.
+func (h *helper) matchAncestors(ctx context.Context, currentProcess Handle, pID uint32) (*ancestorMatch, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "process.matchAncestors")
+	defer span.End()
+
+	parents := make(map[uint32]uint32)
+	if err := h.walkProcesses(func(entry *ProcessEntry32) bool {
+		parents[entry.ProcessID] = entry.ParentProcessID
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list parent processes: %w", err)
+	}
+
+	childCreationTime, err := h.processCreationTime(pID)
+	if err != nil {
+		return nil, err
+	}
+
+	visited := map[uint32]bool{pID: true}
+	for depth := 1; depth <= h.ancestryDepth; depth++ {
+		parentID, ok := parents[pID]
+		if !ok || parentID == 0 || visited[parentID] {
+			return nil, nil
+		}
+		visited[parentID] = true
+
+		parentHandle, err := h.wapi.OpenProcess(ProcessQueryLimitedInformation, false, parentID)
+		if err != nil {
+			h.log.Debug("Unable to open parent process", telemetry.PID, parentID, telemetry.Error, err)
+			return nil, nil
+		}
+
+		// The parent exited and its ID was reused by a newer process
+		parentCreationTime, err := h.handleCreationTime(parentHandle)
+		if err != nil || parentCreationTime > childCreationTime {
+			h.closeHandle(parentHandle, "Could not close parent process handle")
+			h.log.Debug("Parent process was replaced", telemetry.PID, parentID, telemetry.Error, err)
+			return nil, nil
+		}
+
+		jobNames, err := h.matchIndexedJobs(ctx, currentProcess, parentHandle)
+		h.closeHandle(parentHandle, "Could not close parent process handle")
+		if err != nil {
+			return nil, err
+		}
+		if len(jobNames) > 0 {
+			return &ancestorMatch{
+				pID:      int32(parentID),
+				depth:    depth,
+				jobNames: jobNames,
+			}, nil
+		}
+
+		pID = parentID
+		childCreationTime = parentCreationTime
+	}
+	return nil, nil
+}
+
+// Ancestors returns the IDs of the ancestors of the process, its parent first
+func (h *helper) Ancestors(ctx context.Context, pID int32) ([]int32, error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "process.Ancestors")
+	defer span.End()
+
+	parents := make(map[uint32]uint32)
+	if err := h.walkProcesses(func(entry *ProcessEntry32) bool {
+		parents[entry.ProcessID] = entry.ParentProcessID
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list parent processes: %w", err)
+	}
+
+	childCreationTime, err := h.processCreationTime(uint32(pID))
+	if err != nil {
+		return nil, err
+	}
+
+	var ancestors []int32
+	visited := map[uint32]bool{uint32(pID): true}
+	for childID := uint32(pID); ; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		parentID, ok := parents[childID]
+		if !ok || parentID == 0 || visited[parentID] {
+			return ancestors, nil
+		}
+		visited[parentID] = true
+
+		// The parent exited, or its ID was reused by a newer process
+		parentCreationTime, err := h.processCreationTime(parentID)
+		if err != nil || parentCreationTime > childCreationTime {
+			h.log.Debug("Parent process was replaced", telemetry.PID, parentID, telemetry.Error, err)
+			return ancestors, nil
+		}
+
+		ancestors = append(ancestors, int32(parentID))
+		childID = parentID
+		childCreationTime = parentCreationTime
+	}
+}
+
+// processCreationTime returns the creation time of the process
+func (h *helper) processCreationTime(pID uint32) (uint64, error) {
+	hProcess, err := h.wapi.OpenProcess(ProcessQueryLimitedInformation, false, pID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open process: %w", err)
+	}
+	defer h.closeHandle(hProcess, "Could not close process handle")
+
+	return h.handleCreationTime(hProcess)
+}
+
+// handleCreationTime returns the creation time of the process of the handle
+func (h *helper) handleCreationTime(hProcess Handle) (uint64, error) {
+	var creationTime, exitTime, kernelTime, userTime Filetime
+	if err := h.wapi.GetProcessTimes(hProcess, &creationTime, &exitTime, &kernelTime, &userTime); err != nil {
+		return 0, fmt.Errorf("failed to get process times: %w", err)
+	}
+	return creationTime.Value(), nil
+}
@@ -0,0 +1,134 @@
+package process
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestMatchAncestors(t *testing.T) {
+	// addChain adds a container process in a container job and a chain of
+	// descendants, each one created by the previous process
+	addChain := func(f *FakeAPI, pIDs ...uint32) {
+		f.AddProcess(vmcomputePID, "vmcompute.exe")
+		f.AddProcess(pIDs[0], "app.exe")
+		for i, pID := range pIDs[1:] {
+			f.AddChildProcess(pID, pIDs[i], "runas.exe")
+		}
+		f.AddJob(vmcomputePID, 8, `\Container_`+containerID, pIDs[0])
+	}
+
+	for _, tt := range []struct {
+		name          string
+		setup         func(f *FakeAPI)
+		ancestryDepth int
+		pID           int32
+		expResult     Result
+	}{
+		{
+			name: "parent in container job",
+			setup: func(f *FakeAPI) {
+				addChain(f, 200, 300)
+			},
+			ancestryDepth: 3,
+			pID:           300,
+			expResult:     Result{Location: LocationContainer, ContainerID: containerID, AncestorPID: 200, AncestorDepth: 1},
+		},
+		{
+			name: "ancestor at the maximum depth",
+			setup: func(f *FakeAPI) {
+				addChain(f, 200, 300, 400, 500)
+			},
+			ancestryDepth: 3,
+			pID:           500,
+			expResult:     Result{Location: LocationContainer, ContainerID: containerID, AncestorPID: 200, AncestorDepth: 3},
+		},
+		{
+			name: "ancestor beyond the maximum depth",
+			setup: func(f *FakeAPI) {
+				addChain(f, 200, 300, 400, 500)
+			},
+			ancestryDepth: 2,
+			pID:           500,
+			expResult:     Result{Location: LocationHost},
+		},
+		{
+			name: "parent process ID reused",
+			setup: func(f *FakeAPI) {
+				addChain(f, 200, 300)
+				// The parent exits and its ID is reused by a newer container process
+				f.RemoveProcess(200)
+				f.AddProcess(200, "app.exe")
+				f.AddJob(vmcomputePID, 12, `\Container_other`, 200)
+			},
+			ancestryDepth: 3,
+			pID:           300,
+			expResult:     Result{Location: LocationHost},
+		},
+		{
+			name: "ancestry walk disabled",
+			setup: func(f *FakeAPI) {
+				addChain(f, 200, 300)
+			},
+			pID:       300,
+			expResult: Result{Location: LocationHost},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeAPI()
+			tt.setup(f)
+			h := NewHelper(hclog.NewNullLogger(), nil, f, tt.ancestryDepth)
+
+			result, err := h.GetContainerIDByProcess(context.Background(), tt.pID)
+			checkError(t, err, nil)
+			if result != tt.expResult {
+				t.Errorf("unexpected result: got %+v, want %+v", result, tt.expResult)
+			}
+			if n := f.OpenHandles(); n != 0 {
+				t.Errorf("%d handles left open", n)
+			}
+		})
+	}
+}
+
+func TestWindowsAncestryAncestors(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(4, "System")
+	f.AddChildProcess(200, 4, "smss.exe")
+	f.AddChildProcess(300, 200, "cmd.exe")
+	f.AddChildProcess(400, 300, "app.exe")
+	// The parent of 600 exited, and its ID was reused by a newer process
+	f.AddChildProcess(600, 500, "orphan.exe")
+	f.AddProcess(500, "other.exe")
+	a := NewWindowsAncestry(hclog.NewNullLogger(), f)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name      string
+		pID       int32
+		ancestors []int32
+	}{
+		{name: "ancestors", pID: 400, ancestors: []int32{300, 200, 4}},
+		{name: "no parent", pID: 4},
+		{name: "reused parent ID", pID: 600},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ancestors, err := a.Ancestors(ctx, tt.pID)
+			checkError(t, err, nil)
+			if !reflect.DeepEqual(ancestors, tt.ancestors) {
+				t.Errorf("unexpected ancestors: got %v, want %v", ancestors, tt.ancestors)
+			}
+			if n := f.OpenHandles(); n != 0 {
+				t.Errorf("%d handles left open", n)
+			}
+		})
+	}
+
+	if _, err := a.Ancestors(ctx, 999); err == nil {
+		t.Error("expected error for a missing process")
+	}
+}
@@ -0,0 +1,183 @@
+package process
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// DefaultCacheSize is the default maximum number of cached processes
+	DefaultCacheSize = 1024
+
+	defaultPruneInterval = time.Minute
+)
+
+// CachedHelper is a Helper that caches the container ID of processes. Entries are
+// keyed by process ID and creation time, so a reused process ID never returns the
+// container of the previous process.
+type CachedHelper struct {
+	log     hclog.Logger
+	metrics *telemetry.Metrics
+	wapi    API
+	helper  Helper
+	size    int
+
+	mtx     sync.Mutex
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+}
+
+type cacheKey struct {
+	pID          uint32
+	creationTime uint64
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	result Result
+}
+
+// NewCachedHelper creates a CachedHelper in front of the provided helper that
+// keeps at most size processes.
+func NewCachedHelper(log hclog.Logger, metrics *telemetry.Metrics, wapi API, helper Helper, size int) *CachedHelper {
+	return &CachedHelper{
+		log:     log,
+		metrics: metrics,
+		wapi:    wapi,
+		helper:  helper,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// GetContainerIDByProcess returns the cached container of the process,
+// or resolves it with the underlying helper. Only container results are cached,
+// a host process may still be added to a container job, e.g. while the
+// container starts, so host and indeterminate results are resolved every time.
+func (c *CachedHelper) GetContainerIDByProcess(ctx context.Context, pID int32) (Result, error) {
+	creationTime, _, err := c.processTimes(uint32(pID))
+	if err != nil {
+		return Result{}, err
+	}
+	key := cacheKey{pID: uint32(pID), creationTime: creationTime}
+
+	if result, ok := c.get(key); ok {
+		c.metrics.IncrCacheLookup("process", true)
+		return result, nil
+	}
+	c.metrics.IncrCacheLookup("process", false)
+
+	result, err := c.helper.GetContainerIDByProcess(ctx, pID)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if result.Location == LocationContainer {
+		c.add(key, result)
+	}
+	return result, nil
+}
+
+// Run removes the entries of exited processes periodically, until the context is done.
+func (c *CachedHelper) Run(ctx context.Context) error {
+	ticker := time.NewTicker(defaultPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.prune()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *CachedHelper) get(key cacheKey) (Result, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return Result{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).result, true
+}
+
+// add caches the result, evicting the least recently used entry when the cache
+// is full. Entries of exited processes are removed by Run, not on this path.
+func (c *CachedHelper) add(key cacheKey, result Result) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).result = result
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.size && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:    key,
+		result: result,
+	})
+}
+
+// prune removes the entries of processes that exited, or whose process ID was reused
+func (c *CachedHelper) prune() {
+	c.mtx.Lock()
+	keys := make([]cacheKey, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	c.mtx.Unlock()
+
+	for _, key := range keys {
+		creationTime, exited, err := c.processTimes(key.pID)
+		if err == nil && !exited && creationTime == key.creationTime {
+			continue
+		}
+
+		c.log.Debug("Removing exited process from cache", telemetry.PID, key.pID)
+		c.mtx.Lock()
+		if elem, ok := c.entries[key]; ok {
+			c.removeElement(elem)
+		}
+		c.mtx.Unlock()
+	}
+}
+
+func (c *CachedHelper) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// processTimes returns the creation time of the process, and whether it exited
+func (c *CachedHelper) processTimes(pID uint32) (uint64, bool, error) {
+	h, err := c.wapi.OpenProcess(ProcessQueryLimitedInformation, false, pID)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open process: %w", err)
+	}
+	defer func() {
+		if err := c.wapi.CloseHandle(h); err != nil {
+			c.log.Debug("Could not close process handle", telemetry.Error, err)
+		}
+	}()
+
+	var creationTime, exitTime, kernelTime, userTime Filetime
+	if err := c.wapi.GetProcessTimes(h, &creationTime, &exitTime, &kernelTime, &userTime); err != nil {
+		return 0, false, fmt.Errorf("failed to get process times: %w", err)
+	}
+	return creationTime.Value(), exitTime.Value() != 0, nil
+}
@@ -0,0 +1,110 @@
+package process
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func newTestCachedHelper(f *FakeAPI, size int) *CachedHelper {
+	log := hclog.NewNullLogger()
+	return NewCachedHelper(log, nil, f, NewHelper(log, nil, f, 0), size)
+}
+
+func TestCachedHelperEvictsLeastRecentlyUsed(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	for _, pID := range []uint32{200, 300, 400} {
+		f.AddProcess(pID, "app.exe")
+	}
+	f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200, 300, 400)
+	c := newTestCachedHelper(f, 2)
+	ctx := context.Background()
+
+	for _, pID := range []int32{200, 300, 200} {
+		if _, err := c.GetContainerIDByProcess(ctx, pID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// Exited processes are not pruned when the cache is full, the least
+	// recently used entry is evicted instead
+	f.RemoveProcess(200)
+	if _, err := c.GetContainerIDByProcess(ctx, 400); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cachedPIDs(c)[300] || !cachedPIDs(c)[200] || !cachedPIDs(c)[400] {
+		t.Errorf("unexpected cached processes: %v", cachedPIDs(c))
+	}
+
+	c.prune()
+	if cached := cachedPIDs(c); len(cached) != 1 || !cached[400] {
+		t.Errorf("unexpected cached processes after prune: %v", cached)
+	}
+	if n := f.OpenHandles(); n != 0 {
+		t.Errorf("%d handles left open", n)
+	}
+}
+
+func TestCachedHelperIgnoresReusedPID(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	f.AddProcess(200, "app.exe")
+	f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+	c := newTestCachedHelper(f, 2)
+	ctx := context.Background()
+
+	result, err := c.GetContainerIDByProcess(ctx, 200)
+	checkError(t, err, nil)
+	if result.ContainerID != containerID {
+		t.Fatalf("unexpected container ID: %q", result.ContainerID)
+	}
+
+	// The process ID is reused by a host process
+	f.RemoveProcess(200)
+	f.AddProcess(200, "host.exe")
+	result, err = c.GetContainerIDByProcess(ctx, 200)
+	checkError(t, err, nil)
+	if result.Location != LocationHost {
+		t.Errorf("unexpected location: %s", result.Location)
+	}
+}
+
+func TestCachedHelperResolvesHostProcessesAgain(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	f.AddProcess(200, "app.exe")
+	c := newTestCachedHelper(f, 2)
+	ctx := context.Background()
+
+	result, err := c.GetContainerIDByProcess(ctx, 200)
+	checkError(t, err, nil)
+	if result.Location != LocationHost {
+		t.Fatalf("unexpected location: %s", result.Location)
+	}
+	if cached := cachedPIDs(c); len(cached) != 0 {
+		t.Errorf("host process was cached: %v", cached)
+	}
+
+	// The same process is added to a container job, e.g. while the container starts
+	f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+	result, err = c.GetContainerIDByProcess(ctx, 200)
+	checkError(t, err, nil)
+	if result.Location != LocationContainer || result.ContainerID != containerID {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if !cachedPIDs(c)[200] {
+		t.Error("container process was not cached")
+	}
+}
+
+func cachedPIDs(c *CachedHelper) map[uint32]bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	pIDs := make(map[uint32]bool)
+	for key := range c.entries {
+		pIDs[key.pID] = true
+	}
+	return pIDs
+}
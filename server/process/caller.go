@@ -0,0 +1,192 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCallerChanged is returned when the caller process exited, or its PID was
+// reused by another process, after it was attested
+var ErrCallerChanged = errors.New("caller process exited or was replaced during attestation")
+
+const (
+	// callerStartSlack is the precision of the process start times compared
+	// with the connection time, the clocks involved have a granularity of up
+	// to a few tens of milliseconds
+	callerStartSlack = 50 * time.Millisecond
+
+	// clockTicks is USER_HZ, the unit of the times of /proc/<pid>/stat, which
+	// is 100 on all Linux architectures
+	clockTicks = 100
+)
+
+// Caller tracks the process of a Workload API caller, to verify after the slow
+// attestation steps that the selectors still belong to the same process.
+type Caller interface {
+	// Verify returns ErrCallerChanged when the process is no longer the tracked one
+	Verify() error
+
+	// Close releases the resources used to track the process
+	Close() error
+}
+
+// NewWindowsCaller tracks the process by keeping a handle to it open, Windows
+// does not reuse a process ID while there are open handles to the process.
+// ErrCallerChanged is returned when the process was created after connectedAt,
+// its PID was reused before the handle was opened.
+func NewWindowsCaller(wapi API, pID int32, connectedAt time.Time) (Caller, error) {
+	h, err := wapi.OpenProcess(ProcessQueryLimitedInformation, false, uint32(pID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open caller process: %w", err)
+	}
+	c := &windowsCaller{
+		wapi:   wapi,
+		handle: h,
+	}
+
+	var creationTime, exitTime, kernelTime, userTime Filetime
+	if err := wapi.GetProcessTimes(h, &creationTime, &exitTime, &kernelTime, &userTime); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to get caller process times: %w", err)
+	}
+	if exitTime.Value() != 0 || creationTime.Time().After(connectedAt.Add(callerStartSlack)) {
+		c.Close()
+		return nil, ErrCallerChanged
+	}
+	return c, nil
+}
+
+type windowsCaller struct {
+	wapi   API
+	handle Handle
+}
+
+func (c *windowsCaller) Verify() error {
+	var creationTime, exitTime, kernelTime, userTime Filetime
+	if err := c.wapi.GetProcessTimes(c.handle, &creationTime, &exitTime, &kernelTime, &userTime); err != nil {
+		return fmt.Errorf("failed to get caller process times: %w", err)
+	}
+	if exitTime.Value() != 0 {
+		return ErrCallerChanged
+	}
+	return nil
+}
+
+func (c *windowsCaller) Close() error {
+	return c.wapi.CloseHandle(c.handle)
+}
+
+// NewUnixCaller tracks the process by its start time, read from procfs under
+// the provided root directory (usually "/").
+// ErrCallerChanged is returned when the process started after connectedAt,
+// its PID was reused before the start time was read.
+func NewUnixCaller(rootDir string, pID int32, connectedAt time.Time) (Caller, error) {
+	statPath := filepath.Join(rootDir, "proc", strconv.Itoa(int(pID)), "stat")
+	startTime, err := readProcessStartTime(statPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller process start time: %w", err)
+	}
+	startedAt, err := processStartedAt(filepath.Join(rootDir, "proc", "uptime"), startTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller process start time: %w", err)
+	}
+	if startedAt.After(connectedAt.Add(callerStartSlack)) {
+		return nil, ErrCallerChanged
+	}
+	return &unixCaller{
+		statPath:  statPath,
+		startTime: startTime,
+	}, nil
+}
+
+type unixCaller struct {
+	statPath  string
+	startTime string
+}
+
+func (c *unixCaller) Verify() error {
+	startTime, err := readProcessStartTime(c.statPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ErrCallerChanged
+	case err != nil:
+		return fmt.Errorf("failed to get caller process start time: %w", err)
+	case startTime != c.startTime:
+		return ErrCallerChanged
+	default:
+		return nil
+	}
+}
+
+func (c *unixCaller) Close() error {
+	return nil
+}
+
+// readProcessStartTime returns the starttime field of /proc/<pid>/stat, the time
+// the process started after system boot in clock ticks
+func readProcessStartTime(path string) (string, error) {
+	fields, err := readProcessStat(path)
+	if err != nil {
+		return "", err
+	}
+	return fields[statStartTime], nil
+}
+
+// Fields of /proc/<pid>/stat, as indexes of the fields returned by readProcessStat
+const (
+	statParentPID = 1
+	statStartTime = 19
+)
+
+// readProcessStat returns the fields of /proc/<pid>/stat that follow the
+// command name, the first one is the field 3 (state)
+func readProcessStat(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name is between parentheses and may contain spaces,
+	// fields are counted after its closing parenthesis.
+	stat := string(data)
+	idx := strings.LastIndexByte(stat, ')')
+	if idx < 0 {
+		return nil, fmt.Errorf("malformed stat file %s", path)
+	}
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) <= statStartTime {
+		return nil, fmt.Errorf("malformed stat file %s", path)
+	}
+	return fields, nil
+}
+
+// processStartedAt returns when a process started, from its start time in
+// clock ticks after system boot and the system uptime in /proc/uptime
+func processStartedAt(uptimePath, startTime string) (time.Time, error) {
+	now := time.Now()
+	ticks, err := strconv.ParseUint(startTime, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed start time %q: %w", startTime, err)
+	}
+
+	data, err := os.ReadFile(uptimePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("malformed uptime file %s", uptimePath)
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed uptime file %s: %w", uptimePath, err)
+	}
+
+	sinceStart := time.Duration(uptime*float64(time.Second)) - time.Duration(ticks)*time.Second/clockTicks
+	return now.Add(-sinceStart), nil
+}
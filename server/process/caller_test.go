@@ -0,0 +1,112 @@
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// filetimeEpoch is the time of a zero Filetime, the fake clock starts there
+var filetimeEpoch = time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFiletimeTime(t *testing.T) {
+	// 2022-01-01T00:00:00.0000001Z
+	ft := Filetime{LowDateTime: 0x84fc4001, HighDateTime: 0x01d7fea2}
+	expected := time.Date(2022, 1, 1, 0, 0, 0, 100, time.UTC)
+	if got := ft.Time(); !got.Equal(expected) {
+		t.Errorf("unexpected time: got %s, want %s", got, expected)
+	}
+	if got := (Filetime{}).Time(); !got.Equal(filetimeEpoch) {
+		t.Errorf("unexpected time: got %s, want %s", got, filetimeEpoch)
+	}
+}
+
+func TestWindowsCaller(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(200, "app.exe")
+	connectedAt := filetimeEpoch.Add(time.Second)
+
+	caller, err := NewWindowsCaller(f, 200, connectedAt)
+	checkError(t, err, nil)
+	checkError(t, caller.Verify(), nil)
+
+	f.RemoveProcess(200)
+	checkError(t, caller.Verify(), ErrCallerChanged)
+	checkError(t, caller.Close(), nil)
+	if n := f.OpenHandles(); n != 0 {
+		t.Errorf("%d handles left open", n)
+	}
+}
+
+func TestWindowsCallerReusedPID(t *testing.T) {
+	f := NewFakeAPI()
+	connectedAt := filetimeEpoch.Add(time.Second)
+
+	// The caller exited and its PID was reused after it connected
+	f.AdvanceTime(2 * time.Second)
+	f.AddProcess(200, "other.exe")
+
+	_, err := NewWindowsCaller(f, 200, connectedAt)
+	checkError(t, err, ErrCallerChanged)
+	if n := f.OpenHandles(); n != 0 {
+		t.Errorf("%d handles left open", n)
+	}
+
+	_, err = NewWindowsCaller(f, 300, connectedAt)
+	if err == nil {
+		t.Fatal("expected error for a missing process")
+	}
+}
+
+// writeProcessStat writes the stat file of process 4242 with the start time in
+// clock ticks, and the system uptime in seconds
+func writeProcessStat(t *testing.T, rootDir string, startTime, uptime string) {
+	t.Helper()
+	procDir := filepath.Join(rootDir, "proc", "4242")
+	if err := os.MkdirAll(procDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The command name contains spaces and parentheses
+	stat := "4242 (my (app) x) S 1 4242 4242 0 -1 4194560 1 0 0 0 0 0 0 0 20 0 1 0 " + startTime + " 1000 100 0\n"
+	if err := os.WriteFile(filepath.Join(procDir, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "proc", "uptime"), []byte(uptime+" 1000.00\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixCaller(t *testing.T) {
+	rootDir := t.TempDir()
+	// Started 5 seconds ago
+	writeProcessStat(t, rootDir, "9500", "100.00")
+
+	caller, err := NewUnixCaller(rootDir, 4242, time.Now())
+	checkError(t, err, nil)
+	checkError(t, caller.Verify(), nil)
+
+	// Another process with the same PID
+	writeProcessStat(t, rootDir, "9900", "100.00")
+	checkError(t, caller.Verify(), ErrCallerChanged)
+
+	if err := os.RemoveAll(filepath.Join(rootDir, "proc", "4242")); err != nil {
+		t.Fatal(err)
+	}
+	checkError(t, caller.Verify(), ErrCallerChanged)
+	checkError(t, caller.Close(), nil)
+}
+
+func TestUnixCallerReusedPID(t *testing.T) {
+	rootDir := t.TempDir()
+	// Started 5 seconds ago, after the caller connected
+	writeProcessStat(t, rootDir, "9500", "100.00")
+
+	_, err := NewUnixCaller(rootDir, 4242, time.Now().Add(-10*time.Second))
+	checkError(t, err, ErrCallerChanged)
+
+	_, err = NewUnixCaller(rootDir, 300, time.Now())
+	if err == nil {
+		t.Fatal("expected error for a missing process")
+	}
+}
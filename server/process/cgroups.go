@@ -0,0 +1,89 @@
+package process
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+// cgroupContainerID matches the container ID in the last element of a cgroup
+// path, either alone (cgroupfs driver, e.g. /kubepods/besteffort/pod<uid>/<id>)
+// or in a systemd scope (e.g. cri-containerd-<id>.scope, docker-<id>.scope)
+var cgroupContainerID = regexp.MustCompile(`^(?:[a-z-]+-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// NewCgroupsHelper creates a helper that finds the container of a process in
+// its cgroup paths, read from procfs under the provided root directory
+// (usually "/"). It works on Linux nodes only.
+func NewCgroupsHelper(log hclog.Logger, rootDir string) Helper {
+	return &cgroupsHelper{
+		log:     log,
+		rootDir: rootDir,
+	}
+}
+
+type cgroupsHelper struct {
+	log     hclog.Logger
+	rootDir string
+}
+
+func (h *cgroupsHelper) GetContainerIDByProcess(ctx context.Context, pID int32) (Result, error) {
+	_, span := telemetry.Tracer().Start(ctx, "process.cgroups.GetContainerIDByProcess")
+	defer span.End()
+	span.SetAttributes(telemetry.AttrPID.Int64(int64(pID)))
+
+	paths, err := readCgroupPaths(filepath.Join(h.rootDir, "proc", strconv.Itoa(int(pID)), "cgroup"))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read process cgroups: %w", err)
+	}
+
+	var containerID string
+	for _, path := range paths {
+		match := cgroupContainerID.FindStringSubmatch(filepath.Base(path))
+		if match == nil {
+			continue
+		}
+		if containerID != "" && containerID != match[1] {
+			return Result{}, fmt.Errorf("process has multiple container cgroups: %s, %s", containerID, match[1])
+		}
+		containerID = match[1]
+	}
+
+	if containerID == "" {
+		h.log.Debug("No container cgroup found", telemetry.PID, pID)
+		return Result{Location: LocationHost}, nil
+	}
+	span.SetAttributes(telemetry.AttrContainerID.String(containerID))
+	return Result{
+		Location:    LocationContainer,
+		ContainerID: containerID,
+	}, nil
+}
+
+// readCgroupPaths returns the paths of /proc/<pid>/cgroup, lines have the
+// hierarchy ID, the controllers and the path separated by colons
+func readCgroupPaths(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		paths = append(paths, fields[2])
+	}
+	return paths, scanner.Err()
+}
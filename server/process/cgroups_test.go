@@ -0,0 +1,159 @@
+package process
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	cgroupContainerID1 = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	cgroupContainerID2 = "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+)
+
+func TestCgroupsHelperGetContainerIDByProcess(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// cgroup is the content of /proc/4242/cgroup, the process does not
+		// exist when it is empty
+		cgroup      string
+		location    Location
+		containerID string
+		expectErr   bool
+	}{
+		{
+			name: "docker cgroup v1",
+			cgroup: "12:memory:/docker/" + cgroupContainerID1 + "\n" +
+				"11:cpu,cpuacct:/docker/" + cgroupContainerID1 + "\n" +
+				"1:name=systemd:/docker/" + cgroupContainerID1 + "\n",
+			location:    LocationContainer,
+			containerID: cgroupContainerID1,
+		},
+		{
+			name:        "docker systemd scope cgroup v2",
+			cgroup:      "0::/system.slice/docker-" + cgroupContainerID1 + ".scope\n",
+			location:    LocationContainer,
+			containerID: cgroupContainerID1,
+		},
+		{
+			name: "containerd cgroupfs cgroup v1",
+			cgroup: "12:memory:/kubepods/besteffort/pod0d2a4a1e-6f8b-4a5b-9c1d-2e3f4a5b6c7d/" + cgroupContainerID1 + "\n" +
+				"1:name=systemd:/kubepods/besteffort/pod0d2a4a1e-6f8b-4a5b-9c1d-2e3f4a5b6c7d/" + cgroupContainerID1 + "\n",
+			location:    LocationContainer,
+			containerID: cgroupContainerID1,
+		},
+		{
+			name:        "containerd systemd scope cgroup v2",
+			cgroup:      "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod0d2a4a1e.slice/cri-containerd-" + cgroupContainerID1 + ".scope\n",
+			location:    LocationContainer,
+			containerID: cgroupContainerID1,
+		},
+		{
+			name: "cri-o systemd scope cgroup v1",
+			cgroup: "12:memory:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0d2a4a1e.slice/crio-" + cgroupContainerID1 + ".scope\n" +
+				"1:name=systemd:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0d2a4a1e.slice/crio-" + cgroupContainerID1 + ".scope\n",
+			location:    LocationContainer,
+			containerID: cgroupContainerID1,
+		},
+		{
+			name:        "cri-o systemd scope cgroup v2",
+			cgroup:      "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0d2a4a1e.slice/crio-" + cgroupContainerID1 + ".scope\n",
+			location:    LocationContainer,
+			containerID: cgroupContainerID1,
+		},
+		{
+			name: "host process cgroup v1",
+			cgroup: "12:memory:/user.slice\n" +
+				"1:name=systemd:/user.slice/user-1000.slice/session-2.scope\n",
+			location: LocationHost,
+		},
+		{
+			name:     "host process cgroup v2",
+			cgroup:   "0::/system.slice/kubelet.service\n",
+			location: LocationHost,
+		},
+		{
+			name:     "root cgroup",
+			cgroup:   "0::/\n",
+			location: LocationHost,
+		},
+		{
+			name:     "short ID",
+			cgroup:   "0::/docker/a1b2c3d4e5f6\n",
+			location: LocationHost,
+		},
+		{
+			name: "multiple containers",
+			cgroup: "12:memory:/docker/" + cgroupContainerID1 + "\n" +
+				"1:name=systemd:/docker/" + cgroupContainerID2 + "\n",
+			expectErr: true,
+		},
+		{
+			name:      "missing process",
+			expectErr: true,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			if tt.cgroup != "" {
+				writeCgroup(t, rootDir, tt.cgroup)
+			}
+			h := NewCgroupsHelper(hclog.NewNullLogger(), rootDir)
+
+			result, err := h.GetContainerIDByProcess(context.Background(), 4242)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Location != tt.location || result.ContainerID != tt.containerID {
+				t.Errorf("unexpected result: %+v", result)
+			}
+		})
+	}
+}
+
+func TestReadCgroupPaths(t *testing.T) {
+	rootDir := t.TempDir()
+	// Paths may contain colons, and malformed lines are skipped
+	path := writeCgroup(t, rootDir, "12:memory:/docker/a:b\n"+
+		"malformed\n"+
+		"0::/system.slice/kubelet.service\n")
+
+	paths, err := readCgroupPaths(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"/docker/a:b", "/system.slice/kubelet.service"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths: got %v, want %v", paths, expected)
+	}
+
+	if _, err := readCgroupPaths(filepath.Join(rootDir, "proc", "999", "cgroup")); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+// writeCgroup writes the cgroup file of process 4242 under rootDir, and
+// returns its path
+func writeCgroup(t *testing.T, rootDir, content string) string {
+	t.Helper()
+	procDir := filepath.Join(rootDir, "proc", "4242")
+	if err := os.MkdirAll(procDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(procDir, "cgroup")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
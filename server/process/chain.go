@@ -0,0 +1,165 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+// ErrResolverMismatch is returned by a strict chain when its resolvers found
+// the process in different places
+var ErrResolverMismatch = errors.New("container resolvers disagree")
+
+// Results of a resolver lookup recorded in metrics, besides the location names
+const (
+	resolverResultError    = "error"
+	resolverResultMismatch = "mismatch"
+)
+
+// NamedHelper is a container lookup method of a chain
+type NamedHelper struct {
+	// Name identifies the lookup method in logs, metrics and results (e.g. job, cri)
+	Name   string
+	Helper Helper
+}
+
+// NewChainHelper creates a helper that tries the provided helpers in order.
+// The first helper that finds the container of the process wins, errors and
+// indeterminate results fall through to the next helper. Host results fall
+// through too, a helper may report processes of containers that run in the
+// host job context (e.g. HostProcess containers) as host processes; the first
+// host result is returned when no later helper finds a container.
+// In strict mode all the helpers are called and must agree: any error fails
+// the lookup, and ErrResolverMismatch is returned when two of them found the
+// process in different places. Indeterminate results are not compared, and for
+// the same reason host results agree with container results: the container
+// result is returned, as a cri lookup finds the container of a HostProcess
+// container process the job lookup reports as a host process.
+func NewChainHelper(log hclog.Logger, metrics *telemetry.Metrics, helpers []NamedHelper, strict bool) Helper {
+	return &chainHelper{
+		log:     log,
+		metrics: metrics,
+		helpers: helpers,
+		strict:  strict,
+	}
+}
+
+type chainHelper struct {
+	log     hclog.Logger
+	metrics *telemetry.Metrics
+	helpers []NamedHelper
+	strict  bool
+}
+
+func (c *chainHelper) GetContainerIDByProcess(ctx context.Context, pID int32) (result Result, err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "process.chain.GetContainerIDByProcess")
+	defer func() {
+		span.SetAttributes(telemetry.AttrResolver.String(result.Resolver))
+		span.End()
+	}()
+
+	if c.strict {
+		return c.crossCheck(ctx, pID)
+	}
+
+	var firstErr error
+	var host *Result
+	for _, h := range c.helpers {
+		result, err := c.lookup(ctx, h, pID)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+			return Result{}, err
+		case err != nil:
+			c.log.Debug("Resolver failed, trying the next one", telemetry.Resolver, h.Name, telemetry.PID, pID, telemetry.Error, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		case result.Location == LocationContainer:
+			return result, nil
+		case result.Location == LocationHost && host == nil:
+			c.log.Debug("Resolver found a host process, trying the next one", telemetry.Resolver, h.Name, telemetry.PID, pID)
+			host = &result
+		}
+	}
+
+	if host != nil {
+		return *host, nil
+	}
+	// Errors are more useful than an indeterminate result, e.g. ErrHyperVIsolation
+	if firstErr != nil {
+		return Result{}, firstErr
+	}
+	return Result{Location: LocationIndeterminate}, nil
+}
+
+// crossCheck calls all the helpers and returns the result they agree on, the
+// resolver of the result lists the names of all the agreeing helpers
+func (c *chainHelper) crossCheck(ctx context.Context, pID int32) (Result, error) {
+	var agreed Result
+	var resolvers []string
+	for _, h := range c.helpers {
+		result, err := c.lookup(ctx, h, pID)
+		if err != nil {
+			return Result{}, err
+		}
+		if result.Location == LocationIndeterminate {
+			continue
+		}
+
+		if len(resolvers) > 0 && agreed.Location == LocationHost && result.Location == LocationContainer {
+			// A previous helper reported the process of a container in the host
+			// job context as a host process
+			agreed = result
+			resolvers = append(resolvers, h.Name)
+			continue
+		}
+		if len(resolvers) > 0 && agreed.Location == LocationContainer && result.Location == LocationHost {
+			resolvers = append(resolvers, h.Name)
+			continue
+		}
+		if len(resolvers) > 0 && (result.Location != agreed.Location || result.ContainerID != agreed.ContainerID) {
+			c.log.Warn("Container resolvers disagree", telemetry.PID, pID,
+				telemetry.Resolver, agreed.Resolver, telemetry.Location, agreed.Location.String(), telemetry.ContainerID, agreed.ContainerID,
+				"other_"+telemetry.Resolver, h.Name, "other_"+telemetry.Location, result.Location.String(), "other_"+telemetry.ContainerID, result.ContainerID)
+			c.metrics.IncrResolverLookup(h.Name, resolverResultMismatch)
+			return Result{}, fmt.Errorf("%w: %s found %s, %s found %s", ErrResolverMismatch,
+				agreed.Resolver, describeResult(agreed), h.Name, describeResult(result))
+		}
+		if len(resolvers) == 0 {
+			agreed = result
+		} else if agreed.Runtime == "" {
+			agreed.Runtime = result.Runtime
+		}
+		resolvers = append(resolvers, h.Name)
+	}
+
+	if len(resolvers) == 0 {
+		return Result{Location: LocationIndeterminate}, nil
+	}
+	agreed.Resolver = strings.Join(resolvers, ",")
+	return agreed, nil
+}
+
+// lookup calls the helper and records its result
+func (c *chainHelper) lookup(ctx context.Context, h NamedHelper, pID int32) (Result, error) {
+	result, err := h.Helper.GetContainerIDByProcess(ctx, pID)
+	if err != nil {
+		c.metrics.IncrResolverLookup(h.Name, resolverResultError)
+		return Result{}, fmt.Errorf("%s: %w", h.Name, err)
+	}
+	c.metrics.IncrResolverLookup(h.Name, result.Location.String())
+	result.Resolver = h.Name
+	return result, nil
+}
+
+// describeResult returns where the result says the process runs
+func describeResult(result Result) string {
+	if result.Location == LocationContainer {
+		return fmt.Sprintf("container %s", result.ContainerID)
+	}
+	return result.Location.String()
+}
@@ -0,0 +1,125 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// staticHelper returns the same result for every process
+type staticHelper struct {
+	result Result
+	err    error
+}
+
+func (h staticHelper) GetContainerIDByProcess(context.Context, int32) (Result, error) {
+	return h.result, h.err
+}
+
+func TestChainHelper(t *testing.T) {
+	host := staticHelper{result: Result{Location: LocationHost}}
+	container := staticHelper{result: Result{Location: LocationContainer, ContainerID: "a1b2c3d4e5f6"}}
+	otherContainer := staticHelper{result: Result{Location: LocationContainer, ContainerID: "b2c3d4e5f6a1"}}
+	indeterminate := staticHelper{result: Result{Location: LocationIndeterminate}}
+	failing := staticHelper{err: errors.New("oh no")}
+
+	for _, tt := range []struct {
+		name        string
+		helpers     []NamedHelper
+		strict      bool
+		location    Location
+		containerID string
+		resolver    string
+		expectErr   error
+	}{
+		{
+			// e.g. the job lookup reports processes of HostProcess containers as
+			// host processes, the cri lookup finds their container
+			name:        "container after host",
+			helpers:     []NamedHelper{{Name: "job", Helper: host}, {Name: "cri", Helper: container}},
+			location:    LocationContainer,
+			containerID: "a1b2c3d4e5f6",
+			resolver:    "cri",
+		},
+		{
+			name:        "first container wins",
+			helpers:     []NamedHelper{{Name: "job", Helper: container}, {Name: "cri", Helper: otherContainer}},
+			location:    LocationContainer,
+			containerID: "a1b2c3d4e5f6",
+			resolver:    "job",
+		},
+		{
+			name:     "host when no container is found",
+			helpers:  []NamedHelper{{Name: "job", Helper: host}, {Name: "cri", Helper: failing}, {Name: "other", Helper: indeterminate}},
+			location: LocationHost,
+			resolver: "job",
+		},
+		{
+			name:     "host after error",
+			helpers:  []NamedHelper{{Name: "cri", Helper: failing}, {Name: "job", Helper: host}},
+			location: LocationHost,
+			resolver: "job",
+		},
+		{
+			name:      "error over indeterminate",
+			helpers:   []NamedHelper{{Name: "job", Helper: indeterminate}, {Name: "cri", Helper: failing}},
+			expectErr: failing.err,
+		},
+		{
+			name:     "indeterminate",
+			helpers:  []NamedHelper{{Name: "job", Helper: indeterminate}},
+			location: LocationIndeterminate,
+		},
+		{
+			name:      "strict mismatch",
+			helpers:   []NamedHelper{{Name: "job", Helper: container}, {Name: "cri", Helper: otherContainer}},
+			strict:    true,
+			expectErr: ErrResolverMismatch,
+		},
+		{
+			name:        "strict container after host",
+			helpers:     []NamedHelper{{Name: "job", Helper: host}, {Name: "cri", Helper: container}},
+			strict:      true,
+			location:    LocationContainer,
+			containerID: "a1b2c3d4e5f6",
+			resolver:    "job,cri",
+		},
+		{
+			name:        "strict host after container",
+			helpers:     []NamedHelper{{Name: "cri", Helper: container}, {Name: "job", Helper: host}},
+			strict:      true,
+			location:    LocationContainer,
+			containerID: "a1b2c3d4e5f6",
+			resolver:    "cri,job",
+		},
+		{
+			name:      "strict host and mismatched containers",
+			helpers:   []NamedHelper{{Name: "job", Helper: host}, {Name: "cri", Helper: container}, {Name: "other", Helper: otherContainer}},
+			strict:    true,
+			expectErr: ErrResolverMismatch,
+		},
+		{
+			name:        "strict agreement",
+			helpers:     []NamedHelper{{Name: "job", Helper: container}, {Name: "other", Helper: indeterminate}, {Name: "cri", Helper: container}},
+			strict:      true,
+			location:    LocationContainer,
+			containerID: "a1b2c3d4e5f6",
+			resolver:    "job,cri",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChainHelper(hclog.NewNullLogger(), nil, tt.helpers, tt.strict)
+			result, err := c.GetContainerIDByProcess(context.Background(), 4242)
+			checkError(t, err, tt.expectErr)
+			if tt.expectErr != nil {
+				return
+			}
+			if result.Location != tt.location || result.ContainerID != tt.containerID || result.Resolver != tt.resolver {
+				t.Errorf("unexpected result: %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,518 @@
+package process
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+// fakeCurrentProcess is the pseudo handle returned by FakeAPI.CurrentProcess
+const fakeCurrentProcess Handle = ^Handle(0)
+
+// FakeAPI is an in-memory implementation of API. It models processes, the
+// system handle table and the objects (e.g. jobs) referenced by handles, so
+// the helper can be exercised without a Windows host.
+type FakeAPI struct {
+	mtx sync.Mutex
+
+	processes map[uint32]*fakeProcess
+	// handleTable is the system handle table, keyed by owner process and handle value
+	handleTable map[fakeHandleKey]*fakeObject
+	// open are the handles opened through the API and not closed yet
+	open       map[Handle]*fakeOpenHandle
+	nextHandle Handle
+	// clock is used as creation time of new processes and as system time
+	clock uint64
+	// handleQueries is the number of QuerySystemExtendedHandleInformation calls
+	handleQueries int
+
+	queryHandlesErr    error
+	openProcessErrs    map[uint32]error
+	tokenErrs          map[uint32]error
+	duplicateErrs      map[fakeHandleKey]error
+	objectTypeErrs     map[fakeHandleKey]error
+	objectNameErrs     map[fakeHandleKey]error
+	isProcessInJobErrs map[fakeHandleKey]error
+}
+
+type fakeProcess struct {
+	pID          uint32
+	parentPID    uint32
+	exeFile      string
+	creationTime uint64
+	userSID      string
+	imagePath    string
+	groups       []TokenGroup
+	// exitTime is set when the process is removed, open handles to the process remain valid
+	exitTime uint64
+}
+
+type fakeHandleKey struct {
+	pID         uint32
+	handleValue uintptr
+}
+
+type fakeObject struct {
+	key      fakeHandleKey
+	typeName string
+	name     string
+	// members are the processes assigned to a job object
+	members map[uint32]bool
+}
+
+type fakeOpenHandle struct {
+	// process is set on handles returned by OpenProcess
+	process *fakeProcess
+	// object is set on handles returned by DuplicateHandle
+	object *fakeObject
+	// snapshot is set on handles returned by CreateToolhelp32Snapshot
+	snapshot []*fakeProcess
+	next     int
+}
+
+// NewFakeAPI creates a FakeAPI without processes or handles
+func NewFakeAPI() *FakeAPI {
+	return &FakeAPI{
+		processes:          make(map[uint32]*fakeProcess),
+		handleTable:        make(map[fakeHandleKey]*fakeObject),
+		open:               make(map[Handle]*fakeOpenHandle),
+		nextHandle:         4,
+		openProcessErrs:    make(map[uint32]error),
+		tokenErrs:          make(map[uint32]error),
+		duplicateErrs:      make(map[fakeHandleKey]error),
+		objectTypeErrs:     make(map[fakeHandleKey]error),
+		objectNameErrs:     make(map[fakeHandleKey]error),
+		isProcessInJobErrs: make(map[fakeHandleKey]error),
+	}
+}
+
+// AddProcess adds a running process
+func (f *FakeAPI) AddProcess(pID uint32, exeFile string) {
+	f.AddChildProcess(pID, 0, exeFile)
+}
+
+// AddChildProcess adds a running process created by the parent process.
+// Every added process gets a later creation time, so re-adding a process ID
+// models PID reuse.
+func (f *FakeAPI) AddChildProcess(pID, parentPID uint32, exeFile string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.clock++
+	f.processes[pID] = &fakeProcess{
+		pID:          pID,
+		parentPID:    parentPID,
+		exeFile:      exeFile,
+		creationTime: f.clock,
+	}
+}
+
+// SetProcessUser sets the SID of the user the process runs as
+func (f *FakeAPI) SetProcessUser(pID uint32, userSID string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if proc, ok := f.processes[pID]; ok {
+		proc.userSID = userSID
+	}
+}
+
+// SetProcessGroups sets the groups in the process token
+func (f *FakeAPI) SetProcessGroups(pID uint32, groups ...TokenGroup) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if proc, ok := f.processes[pID]; ok {
+		proc.groups = groups
+	}
+}
+
+// SetProcessImagePath sets the full path of the executable image of the process
+func (f *FakeAPI) SetProcessImagePath(pID uint32, imagePath string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if proc, ok := f.processes[pID]; ok {
+		proc.imagePath = imagePath
+	}
+}
+
+// RemoveProcess removes a process, handles owned by it are removed from the
+// handle table and it is no longer a member of any job.
+// Handles to the process that are still open report it as exited.
+func (f *FakeAPI) RemoveProcess(pID uint32) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if proc, ok := f.processes[pID]; ok {
+		f.clock++
+		proc.exitTime = f.clock
+	}
+	delete(f.processes, pID)
+	for key, object := range f.handleTable {
+		if key.pID == pID {
+			delete(f.handleTable, key)
+		}
+		delete(object.members, pID)
+	}
+}
+
+// AddHandle adds a handle owned by the process to an object of the given type and name
+func (f *FakeAPI) AddHandle(ownerPID uint32, handleValue uintptr, typeName, name string) {
+	f.addObject(ownerPID, handleValue, typeName, name)
+}
+
+// AddJob adds a handle owned by the process to a job object with the given
+// name, the member processes are assigned to the job.
+func (f *FakeAPI) AddJob(ownerPID uint32, handleValue uintptr, name string, members ...uint32) {
+	object := f.addObject(ownerPID, handleValue, "Job", name)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, member := range members {
+		object.members[member] = true
+	}
+}
+
+// SetQuerySystemExtendedHandleInformationError makes QuerySystemExtendedHandleInformation fail
+func (f *FakeAPI) SetQuerySystemExtendedHandleInformationError(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.queryHandlesErr = err
+}
+
+// SetOpenProcessError makes OpenProcess fail for the process,
+// e.g. with ErrorAccessDenied
+func (f *FakeAPI) SetOpenProcessError(pID uint32, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.openProcessErrs[pID] = err
+}
+
+// SetProcessTokenError makes the calls that read the token of the process
+// fail, e.g. with ErrorAccessDenied
+func (f *FakeAPI) SetProcessTokenError(pID uint32, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.tokenErrs[pID] = err
+}
+
+// SetDuplicateHandleError makes DuplicateHandle fail for the handle owned by the process,
+// e.g. with ErrorNotSupported
+func (f *FakeAPI) SetDuplicateHandleError(ownerPID uint32, handleValue uintptr, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.duplicateErrs[fakeHandleKey{pID: ownerPID, handleValue: handleValue}] = err
+}
+
+// SetObjectTypeError makes GetObjectType fail for the handle owned by the process
+func (f *FakeAPI) SetObjectTypeError(ownerPID uint32, handleValue uintptr, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.objectTypeErrs[fakeHandleKey{pID: ownerPID, handleValue: handleValue}] = err
+}
+
+// SetObjectNameError makes GetObjectName fail for the handle owned by the process
+func (f *FakeAPI) SetObjectNameError(ownerPID uint32, handleValue uintptr, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.objectNameErrs[fakeHandleKey{pID: ownerPID, handleValue: handleValue}] = err
+}
+
+// SetIsProcessInJobError makes IsProcessInJob fail for the job handle owned by the process
+func (f *FakeAPI) SetIsProcessInJobError(ownerPID uint32, handleValue uintptr, err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.isProcessInJobErrs[fakeHandleKey{pID: ownerPID, handleValue: handleValue}] = err
+}
+
+// AdvanceTime moves the system time forward
+func (f *FakeAPI) AdvanceTime(d time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.clock += uint64(d / 100)
+}
+
+// HandleQueries returns the number of times the system handle table was queried
+func (f *FakeAPI) HandleQueries() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.handleQueries
+}
+
+// OpenHandles returns the number of handles opened through the API that are not closed yet
+func (f *FakeAPI) OpenHandles() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.open)
+}
+
+func (f *FakeAPI) IsProcessInJob(procHandle Handle, jobHandle Handle, result *bool) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	proc, ok := f.open[procHandle]
+	if !ok || proc.process == nil {
+		return syscall.EINVAL
+	}
+	job, ok := f.open[jobHandle]
+	if !ok || job.object == nil {
+		return syscall.EINVAL
+	}
+	if err := f.isProcessInJobErrs[job.object.key]; err != nil {
+		return err
+	}
+
+	*result = job.object.members[proc.process.pID]
+	return nil
+}
+
+func (f *FakeAPI) GetObjectType(handle Handle) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[handle]
+	if !ok || h.object == nil {
+		return "", ErrorInvalidParameter
+	}
+	if err := f.objectTypeErrs[h.object.key]; err != nil {
+		return "", err
+	}
+	return h.object.typeName, nil
+}
+
+func (f *FakeAPI) GetObjectName(handle Handle) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[handle]
+	if !ok || h.object == nil {
+		return "", ErrorInvalidParameter
+	}
+	if err := f.objectNameErrs[h.object.key]; err != nil {
+		return "", err
+	}
+	return h.object.name, nil
+}
+
+func (f *FakeAPI) QuerySystemExtendedHandleInformation() ([]SystemHandleInformationExItem, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.handleQueries++
+	if f.queryHandlesErr != nil {
+		return nil, f.queryHandlesErr
+	}
+
+	items := make([]SystemHandleInformationExItem, 0, len(f.handleTable))
+	for key := range f.handleTable {
+		items = append(items, SystemHandleInformationExItem{
+			UniqueProcessID: uintptr(key.pID),
+			HandleValue:     key.handleValue,
+		})
+	}
+	// Keep results deterministic
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].UniqueProcessID != items[j].UniqueProcessID {
+			return items[i].UniqueProcessID < items[j].UniqueProcessID
+		}
+		return items[i].HandleValue < items[j].HandleValue
+	})
+	return items, nil
+}
+
+func (f *FakeAPI) CurrentProcess() Handle {
+	return fakeCurrentProcess
+}
+
+func (f *FakeAPI) CloseHandle(h Handle) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if _, ok := f.open[h]; !ok {
+		return ErrorInvalidParameter
+	}
+	delete(f.open, h)
+	return nil
+}
+
+func (f *FakeAPI) OpenProcess(desiredAccess uint32, inheritHandle bool, pID uint32) (Handle, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if err := f.openProcessErrs[pID]; err != nil {
+		return 0, err
+	}
+	proc, ok := f.processes[pID]
+	if !ok {
+		return 0, ErrorInvalidParameter
+	}
+	return f.newHandle(&fakeOpenHandle{process: proc}), nil
+}
+
+func (f *FakeAPI) DuplicateHandle(hSourceProcessHandle Handle, hSourceHandle Handle, hTargetProcessHandle Handle, lpTargetHandle *Handle, dwDesiredAccess uint32, bInheritHandle bool, dwOptions uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if hTargetProcessHandle != fakeCurrentProcess {
+		return ErrorInvalidParameter
+	}
+	source, ok := f.open[hSourceProcessHandle]
+	if !ok || source.process == nil {
+		return ErrorInvalidParameter
+	}
+	key := fakeHandleKey{pID: source.process.pID, handleValue: uintptr(hSourceHandle)}
+	if err := f.duplicateErrs[key]; err != nil {
+		return err
+	}
+	object, ok := f.handleTable[key]
+	if !ok {
+		return ErrorInvalidParameter
+	}
+
+	*lpTargetHandle = f.newHandle(&fakeOpenHandle{object: object})
+	return nil
+}
+
+func (f *FakeAPI) CreateToolhelp32Snapshot(flags uint32, pID uint32) (Handle, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if flags != Th32csSnapProcess {
+		return 0, ErrorInvalidParameter
+	}
+
+	snapshot := make([]*fakeProcess, 0, len(f.processes))
+	for _, proc := range f.processes {
+		snapshot = append(snapshot, proc)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].pID < snapshot[j].pID
+	})
+	return f.newHandle(&fakeOpenHandle{snapshot: snapshot}), nil
+}
+
+func (f *FakeAPI) Process32First(snapshot Handle, procEntry *ProcessEntry32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[snapshot]
+	if !ok || h.snapshot == nil {
+		return ErrorInvalidParameter
+	}
+	h.next = 0
+	return f.nextEntry(h, procEntry)
+}
+
+func (f *FakeAPI) Process32Next(snapshot Handle, procEntry *ProcessEntry32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[snapshot]
+	if !ok || h.snapshot == nil {
+		return ErrorInvalidParameter
+	}
+	return f.nextEntry(h, procEntry)
+}
+
+func (f *FakeAPI) GetProcessTimes(process Handle, creationTime, exitTime, kernelTime, userTime *Filetime) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[process]
+	if !ok || h.process == nil {
+		return ErrorInvalidParameter
+	}
+	*creationTime = Filetime{
+		LowDateTime:  uint32(h.process.creationTime),
+		HighDateTime: uint32(h.process.creationTime >> 32),
+	}
+	*exitTime = Filetime{
+		LowDateTime:  uint32(h.process.exitTime),
+		HighDateTime: uint32(h.process.exitTime >> 32),
+	}
+	*kernelTime = Filetime{}
+	*userTime = Filetime{}
+	return nil
+}
+
+func (f *FakeAPI) GetSystemTimeAsFileTime(time *Filetime) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	*time = Filetime{
+		LowDateTime:  uint32(f.clock),
+		HighDateTime: uint32(f.clock >> 32),
+	}
+}
+
+func (f *FakeAPI) GetProcessUserSID(process Handle) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[process]
+	if !ok || h.process == nil {
+		return "", ErrorInvalidParameter
+	}
+	if err := f.tokenErrs[h.process.pID]; err != nil {
+		return "", err
+	}
+	return h.process.userSID, nil
+}
+
+func (f *FakeAPI) QueryFullProcessImageName(process Handle) (string, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[process]
+	if !ok || h.process == nil {
+		return "", ErrorInvalidParameter
+	}
+	return h.process.imagePath, nil
+}
+
+func (f *FakeAPI) GetProcessTokenGroups(process Handle) ([]TokenGroup, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	h, ok := f.open[process]
+	if !ok || h.process == nil {
+		return nil, ErrorInvalidParameter
+	}
+	if err := f.tokenErrs[h.process.pID]; err != nil {
+		return nil, err
+	}
+	return append([]TokenGroup(nil), h.process.groups...), nil
+}
+
+func (f *FakeAPI) nextEntry(h *fakeOpenHandle, procEntry *ProcessEntry32) error {
+	if h.next >= len(h.snapshot) {
+		return ErrorNoMoreFiles
+	}
+	proc := h.snapshot[h.next]
+	h.next++
+
+	procEntry.ProcessID = proc.pID
+	procEntry.ParentProcessID = proc.parentPID
+	procEntry.ExeFile = [maxPath]uint16{}
+	copy(procEntry.ExeFile[:maxPath-1], utf16.Encode([]rune(proc.exeFile)))
+	return nil
+}
+
+func (f *FakeAPI) addObject(ownerPID uint32, handleValue uintptr, typeName, name string) *fakeObject {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	key := fakeHandleKey{pID: ownerPID, handleValue: handleValue}
+	object := &fakeObject{
+		key:      key,
+		typeName: typeName,
+		name:     name,
+		members:  make(map[uint32]bool),
+	}
+	f.handleTable[key] = object
+	return object
+}
+
+func (f *FakeAPI) newHandle(h *fakeOpenHandle) Handle {
+	handle := f.nextHandle
+	f.nextHandle += 4
+	f.open[handle] = h
+	return handle
+}
@@ -1,176 +1,539 @@
-//go:build windows
-// +build windows
-
 package process
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"os"
 	"strings"
-	"syscall"
+	"time"
 	"unsafe"
 
-	"golang.org/x/sys/windows"
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/codes"
 )
 
 const (
 	containerPrefix = `\Container_`
+
+	// cancellationCheckInterval is the number of handles scanned between context checks
+	cancellationCheckInterval = 1024
+
+	// hyperVWorkerExeFile is the worker process of Hyper-V virtual machines, the
+	// processes of Hyper-V isolated containers run inside a utility VM and
+	// connections from them are seen as coming from the worker process.
+	hyperVWorkerExeFile = "vmwp.exe"
+
+	// virtualMachineSIDPrefix is the prefix of the NT VIRTUAL MACHINE accounts,
+	// every Hyper-V worker process runs as the account of its virtual machine
+	virtualMachineSIDPrefix = "S-1-5-83-"
+
+	defaultSystemRoot = `C:\Windows`
+
+	// jobAssignmentGrace is the time, in 100-nanosecond intervals, a container
+	// process may run before it is assigned to its container job. Processes
+	// created earlier than that before the last handle scan were already
+	// matched against all the container jobs they could belong to.
+	jobAssignmentGrace = 5 * 10_000_000
+)
+
+// ErrHyperVIsolation is returned when the process runs in a Hyper-V isolated
+// container, those processes are not assigned to a container job on the host.
+// The container of the process is not resolved: the worker process serves the
+// whole utility VM, so it can not tell its containers apart.
+var ErrHyperVIsolation = errors.New("unsupported isolation: process runs in a Hyper-V isolated container")
+
+// ErrRuntimeMismatch is returned by pod sources when the container is reported
+// with a runtime other than the one the process lookup found it with
+var ErrRuntimeMismatch = errors.New("container runtime mismatch")
+
+// Location describes where a process runs
+type Location int
+
+const (
+	// LocationIndeterminate is returned when it is not possible to know if the
+	// process runs in a container, e.g. access to all vmcompute processes is denied
+	LocationIndeterminate Location = iota
+	// LocationHost is returned for processes that run on the host
+	LocationHost
+	// LocationContainer is returned for processes that run in a container
+	LocationContainer
 )
 
+func (l Location) String() string {
+	switch l {
+	case LocationHost:
+		return "host"
+	case LocationContainer:
+		return "container"
+	default:
+		return "indeterminate"
+	}
+}
+
+// Result is the result of looking up the container of a process
+type Result struct {
+	Location Location
+
+	// ContainerID is set when the process runs in a container
+	ContainerID string
+
+	// AncestorPID is set when the process is not assigned to the container
+	// job itself, but the ancestor with this process ID is
+	AncestorPID int32
+
+	// AncestorDepth is the number of levels between the process and AncestorPID
+	AncestorDepth int
+
+	// Resolver is the name of the lookup method that resolved the process, set
+	// by a chain of helpers
+	Resolver string
+
+	// Runtime is the runtime scheme (e.g. containerd, docker) of the container,
+	// set by lookup methods that ask the runtime. The job handles of vmcompute
+	// do not tell which runtime created the container.
+	Runtime string
+}
+
+// Indirect returns true when the container was found through an ancestor
+func (r Result) Indirect() bool {
+	return r.AncestorDepth > 0
+}
+
 type Helper interface {
-	GetContainerIDByProcess(pID int32) (string, error)
+	GetContainerIDByProcess(ctx context.Context, pID int32) (Result, error)
 }
 
-func CreateHelper() Helper {
+// NewHelper creates a helper that performs the Windows calls through the
+// provided API, it allows to replace the Windows API in tests.
+// When ancestryDepth is greater than zero, processes that are not in a container
+// job are looked up through their parents, up to ancestryDepth levels.
+func NewHelper(log hclog.Logger, metrics *telemetry.Metrics, wapi API, ancestryDepth int) Helper {
 	return &helper{
-		wapi: &api{},
+		log:           log,
+		metrics:       metrics,
+		wapi:          wapi,
+		index:         newJobIndex(),
+		ancestryDepth: ancestryDepth,
+		hyperVWorker:  hyperVWorkerPath(),
 	}
 }
 
 type helper struct {
-	wapi API
+	log           hclog.Logger
+	metrics       *telemetry.Metrics
+	wapi          API
+	index         *jobIndex
+	ancestryDepth int
+	// hyperVWorker is the image path of the system Hyper-V worker process
+	hyperVWorker string
+}
+
+// hyperVWorkerPath returns the image path of the system Hyper-V worker process
+func hyperVWorkerPath() string {
+	systemRoot := os.Getenv("SystemRoot")
+	if systemRoot == "" {
+		systemRoot = defaultSystemRoot
+	}
+	return strings.TrimRight(systemRoot, `\`) + `\System32\` + hyperVWorkerExeFile
 }
 
 // GetContainerIDByProcess gets the container ID from the provided process ID,
 // on windows process that are running in a docker containers are grouped by Named Jobs,
 // those Jobs has the container ID as name.
 // In the format `\Container_${CONTAINER_ID}`
-func (h *helper) GetContainerIDByProcess(pID int32) (string, error) {
+// Container jobs owned by vmcompute are kept in an index, the system handle
+// table is only scanned for new vmcompute processes, or when a process that is
+// not found in any indexed job was created after the last scan, so its
+// container job may not be indexed yet.
+func (h *helper) GetContainerIDByProcess(ctx context.Context, pID int32) (result Result, err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "process.GetContainerIDByProcess")
+	span.SetAttributes(telemetry.AttrPID.Int64(int64(pID)))
+
+	var handleCount, vmcomputeCount int
+	start := time.Now()
+	defer func() {
+		h.metrics.ObserveContainerLookup(time.Since(start), handleCount, vmcomputeCount)
+
+		span.SetAttributes(
+			telemetry.AttrHandleCount.Int(handleCount),
+			telemetry.AttrContainerID.String(result.ContainerID),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	// Search all processes that run vmcompute.exe
+	_, searchSpan := telemetry.Tracer().Start(ctx, "process.searchProcessByExeFile")
 	vmComputeProcessIds, err := h.searchProcessByExeFile("vmcompute.exe")
+	searchSpan.End()
 	if err != nil {
-		return "", fmt.Errorf("failed to search vmcompute process: %w", err)
+		return Result{}, fmt.Errorf("failed to search vmcompute process: %w", err)
 	}
+	vmcomputeCount = len(vmComputeProcessIds)
 
 	// Get current process. The handle must not be closed.
 	currentProcess := h.wapi.CurrentProcess()
 
 	// Duplicate the process handle that we want to validate, with limited permissions.
-	childProcessHandle, err := h.wapi.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pID))
+	childProcessHandle, err := h.wapi.OpenProcess(ProcessQueryLimitedInformation, false, uint32(pID))
 	if err != nil {
-		return "", fmt.Errorf("failed to open child process: %w", err)
+		return Result{}, fmt.Errorf("failed to open child process: %w", err)
 	}
 	defer func() {
 		if err := h.wapi.CloseHandle(childProcessHandle); err != nil {
-			// log.Debug("Could not close child process handle", telemetry.Error, err)
+			h.log.Debug("Could not close child process handle", telemetry.Error, err)
 		}
 	}()
 
+	// Only scan the handles of vmcompute processes that are not indexed yet
+	missing := h.index.sync(vmComputeProcessIds)
+	if len(missing) > 0 {
+		n, err := h.indexJobs(ctx, missing, currentProcess)
+		if err != nil {
+			return Result{}, err
+		}
+		handleCount += n
+	}
+
+	jobNames, err := h.matchIndexedJobs(ctx, currentProcess, childProcessHandle)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// The job may belong to a container created after its vmcompute process
+	// was indexed, reindex all vmcompute processes and retry. Processes that
+	// already existed when the handles were scanned are not in a container.
+	fullScan := len(missing) == len(vmComputeProcessIds)
+	h.metrics.IncrCacheLookup("job_index", len(jobNames) > 0 && len(missing) == 0)
+	if len(jobNames) == 0 && !fullScan {
+		creationTime, err := h.handleCreationTime(childProcessHandle)
+		if err != nil {
+			return Result{}, err
+		}
+		if h.index.scannedBefore(creationTime + jobAssignmentGrace) {
+			n, err := h.indexJobs(ctx, vmComputeProcessIds, currentProcess)
+			if err != nil {
+				return Result{}, err
+			}
+			handleCount += n
+			jobNames, err = h.matchIndexedJobs(ctx, currentProcess, childProcessHandle)
+			if err != nil {
+				return Result{}, err
+			}
+		}
+	}
+
+	var ancestor *ancestorMatch
+	if len(jobNames) == 0 && h.ancestryDepth > 0 {
+		ancestor, err = h.matchAncestors(ctx, currentProcess, uint32(pID))
+		if err != nil {
+			return Result{}, err
+		}
+		if ancestor != nil {
+			h.log.Debug("Found container job of ancestor", telemetry.PID, pID, telemetry.AncestorPID, ancestor.pID, telemetry.Depth, ancestor.depth)
+			jobNames = ancestor.jobNames
+		}
+	}
+
+	switch len(jobNames) {
+	case 0:
+		exeFile, err := h.getProcessExeFile(uint32(pID))
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to get process exe file: %w", err)
+		}
+		hyperVWorker, err := h.isHyperVWorker(exeFile, childProcessHandle)
+		if err != nil {
+			return Result{}, err
+		}
+		if hyperVWorker {
+			return Result{}, ErrHyperVIsolation
+		}
+		if len(vmComputeProcessIds) > 0 && !h.canInspectAny(vmComputeProcessIds) {
+			return Result{Location: LocationIndeterminate}, nil
+		}
+		return Result{Location: LocationHost}, nil
+	case 1:
+		result := Result{
+			Location:    LocationContainer,
+			ContainerID: jobNames[0][len(containerPrefix):],
+		}
+		if ancestor != nil {
+			result.AncestorPID = ancestor.pID
+			result.AncestorDepth = ancestor.depth
+		}
+		return result, nil
+	default:
+		return Result{}, fmt.Errorf("process has multiple jobs: %v", jobNames)
+	}
+}
+
+// indexJobs scans the system handle table for container jobs owned by the
+// provided vmcompute processes and replaces their entries in the index. It
+// returns the number of handles scanned.
+func (h *helper) indexJobs(ctx context.Context, vmComputeProcessIds []uint32, currentProcess Handle) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Jobs created after the query are not indexed, so the time is taken before it
+	var scannedAt Filetime
+	h.wapi.GetSystemTimeAsFileTime(&scannedAt)
+
+	_, querySpan := telemetry.Tracer().Start(ctx, "process.QuerySystemExtendedHandleInformation")
 	handles, err := h.wapi.QuerySystemExtendedHandleInformation()
+	querySpan.End()
 	if err != nil {
-		return "", fmt.Errorf("failed to query for extended handle information: %w", err)
+		return 0, fmt.Errorf("failed to query for extended handle information: %w", err)
 	}
 
-	// Verify if process ID is a vmcompute process
-	isVmcomputeProcess := func(pID uint32) bool {
-		for _, vmID := range vmComputeProcessIds {
-			if pID == vmID {
-				return true
+	_, scanSpan := telemetry.Tracer().Start(ctx, "process.scanHandles")
+	defer scanSpan.End()
+
+	jobs := make(map[uint32][]indexedJob, len(vmComputeProcessIds))
+	for _, pID := range vmComputeProcessIds {
+		jobs[pID] = nil
+	}
+
+	for i, handle := range handles {
+		// Stop scanning when the caller is gone or the deadline is exceeded,
+		// checked periodically to not slow down the scan of large tables
+		if i%cancellationCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return i, fmt.Errorf("handle scan interrupted: %w", err)
 			}
 		}
-		return false
+
+		// Filter all handles related with vmcompute processes
+		pID := uint32(handle.UniqueProcessID)
+		if _, ok := jobs[pID]; !ok {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return i, fmt.Errorf("handle scan interrupted: %w", err)
+		}
+
+		jobHandle, jobName, err := h.openContainerJob(handle, currentProcess)
+		if err != nil {
+			h.log.Debug("Unable to get job name", telemetry.Error, err)
+			continue
+		}
+		if jobHandle == 0 {
+			continue
+		}
+		h.closeHandle(jobHandle, "Could not close duplicated process handle")
+
+		h.log.Debug("Indexed container job", telemetry.JobName, jobName, telemetry.PID, pID)
+		jobs[pID] = append(jobs[pID], indexedJob{
+			handle: handle,
+			name:   jobName,
+		})
 	}
 
+	for pID, each := range jobs {
+		h.index.set(pID, each, scannedAt.Value())
+	}
+
+	return len(handles), nil
+}
+
+// matchIndexedJobs returns the names of the indexed jobs the child process
+// is assigned to. Jobs whose handle is no longer valid are removed from the index.
+func (h *helper) matchIndexedJobs(ctx context.Context, currentProcess Handle, childProcessHandle Handle) ([]string, error) {
+	_, span := telemetry.Tracer().Start(ctx, "process.matchIndexedJobs")
+	defer span.End()
+
 	var jobNames []string
-	for _, handle := range handles {
-		// Filter all handles related with vmcompute processes
-		if !isVmcomputeProcess(uint32(handle.UniqueProcessID)) {
+	for _, job := range h.index.list() {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("job match interrupted: %w", err)
+		}
+
+		jobHandle, jobName, err := h.openContainerJob(job.handle, currentProcess)
+		if err != nil {
+			h.log.Debug("Unable to get job name", telemetry.Error, err)
+		}
+
+		// The handle was closed or reused since it was indexed
+		if jobHandle == 0 || jobName != job.name {
+			h.log.Debug("Removing stale container job", telemetry.JobName, job.name)
+			h.index.remove(job)
+			if jobHandle != 0 {
+				h.closeHandle(jobHandle, "Could not close duplicated process handle")
+			}
 			continue
 		}
 
-		jobName, err := h.getJobName(handle, currentProcess, childProcessHandle)
+		isProcessInJob := false
+		err = h.wapi.IsProcessInJob(childProcessHandle, jobHandle, &isProcessInJob)
+		h.closeHandle(jobHandle, "Could not close duplicated process handle")
 		if err != nil {
-			// log.Debug("Unable to get job name", telemetry.Error, err)
+			h.log.Debug("Failed to call IsProcessInJob", telemetry.JobName, jobName, telemetry.Error, err)
 			continue
 		}
-		log.Printf("job: %q \n", jobName)
-		if jobName != "" {
+
+		if isProcessInJob {
+			h.log.Debug("Found container job", telemetry.JobName, jobName)
 			jobNames = append(jobNames, jobName)
 		}
 	}
 
-	switch len(jobNames) {
-	case 0:
-		return "", nil
-	case 1:
-		return jobNames[0][len(containerPrefix):], nil
-	default:
-		return "", fmt.Errorf("process has multiple jobs: %v", jobNames)
+	return jobNames, nil
+}
+
+// canInspectAny returns true if at least one of the processes can be opened
+// to duplicate its handles
+func (h *helper) canInspectAny(pIDs []uint32) bool {
+	for _, pID := range pIDs {
+		hProcess, err := h.wapi.OpenProcess(ProcessDupHandle, false, pID)
+		if err != nil {
+			h.log.Debug("Unable to open vmcompute process", telemetry.PID, pID, telemetry.Error, err)
+			continue
+		}
+		h.closeHandle(hProcess, "Could not close process handle")
+		return true
 	}
+	return false
 }
 
 // searchProcessByExeFile searches all the processes with specified exe file
 func (h *helper) searchProcessByExeFile(exeFile string) ([]uint32, error) {
+	var results []uint32
+	err := h.walkProcesses(func(entry *ProcessEntry32) bool {
+		if utf16ToString(entry.ExeFile[:]) == exeFile {
+			results = append(results, entry.ProcessID)
+		}
+		return true
+	})
+	return results, err
+}
+
+// getProcessExeFile gets the exe file of the process
+func (h *helper) getProcessExeFile(pID uint32) (string, error) {
+	var exeFile string
+	found := false
+	err := h.walkProcesses(func(entry *ProcessEntry32) bool {
+		if entry.ProcessID == pID {
+			exeFile = utf16ToString(entry.ExeFile[:])
+			found = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("process %d not found", pID)
+	}
+	return exeFile, nil
+}
+
+// isHyperVWorker returns true when the process is the system Hyper-V worker
+// process: its image is vmwp.exe in the system directory and it runs as a
+// virtual machine account. Any other process named vmwp.exe runs on the host.
+func (h *helper) isHyperVWorker(exeFile string, processHandle Handle) (bool, error) {
+	if !strings.EqualFold(exeFile, hyperVWorkerExeFile) {
+		return false, nil
+	}
+
+	imagePath, err := h.wapi.QueryFullProcessImageName(processHandle)
+	if err != nil {
+		return false, fmt.Errorf("failed to get process image path: %w", err)
+	}
+	if !strings.EqualFold(imagePath, h.hyperVWorker) {
+		h.log.Debug("Process is not the system Hyper-V worker", telemetry.ImagePath, imagePath)
+		return false, nil
+	}
+
+	userSID, err := h.wapi.GetProcessUserSID(processHandle)
+	if err != nil {
+		return false, fmt.Errorf("failed to get process user: %w", err)
+	}
+	if !strings.HasPrefix(userSID, virtualMachineSIDPrefix) {
+		h.log.Debug("Process does not run as a virtual machine", telemetry.UserSID, userSID)
+		return false, nil
+	}
+	return true, nil
+}
+
+// walkProcesses calls fn for every process in a system snapshot, until fn returns false
+func (h *helper) walkProcesses(fn func(entry *ProcessEntry32) bool) error {
 	snapshotHandle, err := h.wapi.CreateToolhelp32Snapshot(Th32csSnapProcess, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call CreateToolhelp32Snapshot: %w", err)
+		return fmt.Errorf("failed to call CreateToolhelp32Snapshot: %w", err)
 	}
 	defer func() {
 		if err := h.wapi.CloseHandle(snapshotHandle); err != nil {
-			// log.Debug("Could not close snapshot process handle", telemetry.Error, err)
+			h.log.Debug("Could not close snapshot process handle", telemetry.Error, err)
 		}
 	}()
 
-	var entry windows.ProcessEntry32
+	var entry ProcessEntry32
 	entry.Size = uint32(unsafe.Sizeof(entry))
 
 	if err := h.wapi.Process32First(snapshotHandle, &entry); err != nil {
-		return nil, fmt.Errorf("failed to call Process32First: %w", err)
+		return fmt.Errorf("failed to call Process32First: %w", err)
 	}
 
-	var results []uint32
-
 	for {
-		entryExeFile := syscall.UTF16ToString(entry.ExeFile[:])
-		if entryExeFile == exeFile {
-			results = append(results, entry.ProcessID)
+		if !fn(&entry) {
+			return nil
 		}
 
 		if err := h.wapi.Process32Next(snapshotHandle, &entry); err != nil {
-			if errors.Is(err, windows.ERROR_NO_MORE_FILES) {
-				break
+			if errors.Is(err, ErrorNoMoreFiles) {
+				return nil
 			}
-			return nil, fmt.Errorf("failed to call Process32Next: %w", err)
+			return fmt.Errorf("failed to call Process32Next: %w", err)
 		}
 	}
-
-	return results, nil
 }
 
-func (h *helper) getJobName(handle SystemHandleInformationExItem, currentProcess windows.Handle, childProcessHandle windows.Handle) (string, error) {
+// openContainerJob duplicates the handle into the current process and returns
+// it along with the job name when the handle is a container job, otherwise
+// the returned handle is zero. The caller must close the returned handle.
+func (h *helper) openContainerJob(handle SystemHandleInformationExItem, currentProcess Handle) (Handle, string, error) {
 	// Open the handle associated with the process ID, with permissions to duplicate the handle
-	hProcess, err := h.wapi.OpenProcess(windows.PROCESS_DUP_HANDLE, false, uint32(handle.UniqueProcessID))
+	hProcess, err := h.wapi.OpenProcess(ProcessDupHandle, false, uint32(handle.UniqueProcessID))
 	if err != nil {
-		if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		if errors.Is(err, ErrorAccessDenied) {
 			// This is expected when trying to open process as a non admin user
-			return "", nil
+			return 0, "", nil
 		}
-		return "", fmt.Errorf("failed to open unique process: %w", err)
+		return 0, "", fmt.Errorf("failed to open unique process: %w", err)
 	}
-	defer func() {
-		if err := h.wapi.CloseHandle(hProcess); err != nil {
-			// log.Debug("Could not close process handle", telemetry.Error, err)
-		}
-	}()
+	defer h.closeHandle(hProcess, "Could not close process handle")
 
 	// Duplicate handle to get information
-	var dupHandle windows.Handle
-	if err := h.wapi.DuplicateHandle(hProcess, windows.Handle(handle.HandleValue), currentProcess, &dupHandle,
-		0, true, windows.DUPLICATE_SAME_ACCESS); err != nil {
-		if errors.Is(err, windows.ERROR_NOT_SUPPORTED) {
+	var dupHandle Handle
+	if err := h.wapi.DuplicateHandle(hProcess, Handle(handle.HandleValue), currentProcess, &dupHandle,
+		0, true, DuplicateSameAccess); err != nil {
+		if errors.Is(err, ErrorNotSupported) {
 			// This is expected when trying to duplicate a process that
 			// is not managed by docker
-			return "", nil
+			return 0, "", nil
 		}
-		return "", fmt.Errorf("failed to duplicate handle: %w", err)
+		return 0, "", fmt.Errorf("failed to duplicate handle: %w", err)
 	}
-	defer func() {
-		if err := h.wapi.CloseHandle(dupHandle); err != nil {
-			// log.Debug("Could not close duplicated process handle", telemetry.Error, err)
-		}
-	}()
 
+	jobName, err := h.getContainerJobName(dupHandle)
+	if err != nil || jobName == "" {
+		h.closeHandle(dupHandle, "Could not close duplicated process handle")
+		return 0, "", err
+	}
+
+	return dupHandle, jobName, nil
+}
+
+// getContainerJobName returns the name of the job when the handle is a
+// container job, and an empty string otherwise.
+func (h *helper) getContainerJobName(dupHandle Handle) (string, error) {
 	typeName, err := h.wapi.GetObjectType(dupHandle)
 	if err != nil {
 		return "", fmt.Errorf("failed to get Object type: %w", err)
@@ -181,15 +544,6 @@ func (h *helper) getJobName(handle SystemHandleInformationExItem, currentProcess
 		return "", nil
 	}
 
-	isProcessInJob := false
-	if err := h.wapi.IsProcessInJob(childProcessHandle, dupHandle, &isProcessInJob); err != nil {
-		return "", fmt.Errorf("failed to call IsProcessInJob: %w", err)
-	}
-
-	if !isProcessInJob {
-		return "", nil
-	}
-
 	objectName, err := h.wapi.GetObjectName(dupHandle)
 	if err != nil {
 		return "", fmt.Errorf("failed to get object name: %w", err)
@@ -201,3 +555,9 @@ func (h *helper) getJobName(handle SystemHandleInformationExItem, currentProcess
 	}
 	return objectName, nil
 }
+
+func (h *helper) closeHandle(handle Handle, msg string) {
+	if err := h.wapi.CloseHandle(handle); err != nil {
+		h.log.Debug(msg, telemetry.Error, err)
+	}
+}
@@ -0,0 +1,378 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	vmcomputePID = 100
+	containerID  = "0123456789abcdef"
+	// virtualMachineSID is the account of a Hyper-V virtual machine
+	virtualMachineSID = "S-1-5-83-1-1126303870-1285437651-2713513143-2316113466"
+)
+
+func newTestHelper(wapi API) Helper {
+	return NewHelper(hclog.NewNullLogger(), nil, wapi, 0)
+}
+
+func TestGetContainerIDByProcess(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		setup     func(f *FakeAPI)
+		pID       int32
+		expResult Result
+		expErr    error
+	}{
+		{
+			name: "process in container job",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationContainer, ContainerID: containerID},
+		},
+		{
+			name: "process in job without container prefix",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.AddJob(vmcomputePID, 8, `\BaseNamedObjects\`+containerID, 200)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationHost},
+		},
+		{
+			name: "process not in any job",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.AddProcess(300, "other.exe")
+				f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 300)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationHost},
+		},
+		{
+			name: "no vmcompute process",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(200, "app.exe")
+			},
+			pID:       200,
+			expResult: Result{Location: LocationHost},
+		},
+		{
+			name: "vmcompute can not be inspected",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.SetOpenProcessError(vmcomputePID, ErrorAccessDenied)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationIndeterminate},
+		},
+		{
+			name: "Hyper-V isolated container",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "vmwp.exe")
+				f.SetProcessImagePath(200, hyperVWorkerPath())
+				f.SetProcessUser(200, virtualMachineSID)
+			},
+			pID:    200,
+			expErr: ErrHyperVIsolation,
+		},
+		{
+			name: "vmwp.exe outside the system directory",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "vmwp.exe")
+				f.SetProcessImagePath(200, `C:\Users\app\vmwp.exe`)
+				f.SetProcessUser(200, virtualMachineSID)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationHost},
+		},
+		{
+			name: "vmwp.exe not run by a virtual machine account",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "vmwp.exe")
+				f.SetProcessImagePath(200, hyperVWorkerPath())
+				f.SetProcessUser(200, "S-1-5-21-1004336348-1177238915-682003330-1001")
+			},
+			pID:       200,
+			expResult: Result{Location: LocationHost},
+		},
+		{
+			name: "non job handles are ignored",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.AddHandle(vmcomputePID, 4, "Event", `\Container_`+containerID)
+				f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationContainer, ContainerID: containerID},
+		},
+		{
+			name: "handles that can not be duplicated are ignored",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.AddJob(vmcomputePID, 4, `\Container_other`, 200)
+				f.SetDuplicateHandleError(vmcomputePID, 4, ErrorNotSupported)
+				f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+			},
+			pID:       200,
+			expResult: Result{Location: LocationContainer, ContainerID: containerID},
+		},
+		{
+			name: "process in multiple container jobs",
+			setup: func(f *FakeAPI) {
+				f.AddProcess(vmcomputePID, "vmcompute.exe")
+				f.AddProcess(200, "app.exe")
+				f.AddJob(vmcomputePID, 4, `\Container_a`, 200)
+				f.AddJob(vmcomputePID, 8, `\Container_b`, 200)
+			},
+			pID:    200,
+			expErr: errors.New("process has multiple jobs: [\\Container_a \\Container_b]"),
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeAPI()
+			tt.setup(f)
+
+			result, err := newTestHelper(f).GetContainerIDByProcess(context.Background(), tt.pID)
+			checkError(t, err, tt.expErr)
+			if result != tt.expResult {
+				t.Errorf("unexpected result: got %+v, want %+v", result, tt.expResult)
+			}
+			if n := f.OpenHandles(); n != 0 {
+				t.Errorf("%d handles left open", n)
+			}
+		})
+	}
+}
+
+func TestGetContainerIDByProcessIndexesNewJobs(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	f.AddProcess(200, "app.exe")
+	h := newTestHelper(f)
+
+	result, err := h.GetContainerIDByProcess(context.Background(), 200)
+	checkError(t, err, nil)
+	if result.Location != LocationHost {
+		t.Fatalf("unexpected location: %s", result.Location)
+	}
+
+	// A container created after vmcompute was indexed is found
+	f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+	result, err = h.GetContainerIDByProcess(context.Background(), 200)
+	checkError(t, err, nil)
+	if result.ContainerID != containerID {
+		t.Fatalf("unexpected container ID: %q", result.ContainerID)
+	}
+
+	// Jobs of a restarted vmcompute process are dropped from the index
+	f.RemoveProcess(200)
+	f.AddProcess(200, "app.exe")
+	f.RemoveProcess(vmcomputePID)
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	result, err = h.GetContainerIDByProcess(context.Background(), 200)
+	checkError(t, err, nil)
+	if result.Location != LocationHost {
+		t.Fatalf("unexpected location: %s", result.Location)
+	}
+}
+
+func TestGetContainerIDByProcessSkipsRescanForOldProcesses(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	f.AddProcess(200, "host.exe")
+	h := newTestHelper(f)
+
+	f.AdvanceTime(time.Minute)
+	for i := 0; i < 3; i++ {
+		result, err := h.GetContainerIDByProcess(context.Background(), 200)
+		checkError(t, err, nil)
+		if result.Location != LocationHost {
+			t.Fatalf("unexpected location: %s", result.Location)
+		}
+	}
+	if n := f.HandleQueries(); n != 1 {
+		t.Errorf("expected the handle table to be scanned once, got %d scans", n)
+	}
+
+	// A process created after the scan may be in a new container job
+	f.AddProcess(300, "app.exe")
+	f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 300)
+	result, err := h.GetContainerIDByProcess(context.Background(), 300)
+	checkError(t, err, nil)
+	if result.ContainerID != containerID {
+		t.Fatalf("unexpected container ID: %q", result.ContainerID)
+	}
+	if n := f.HandleQueries(); n != 2 {
+		t.Errorf("expected the handle table to be scanned twice, got %d scans", n)
+	}
+}
+
+func TestGetContainerIDByProcessErrors(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	h := newTestHelper(f)
+
+	_, err := h.GetContainerIDByProcess(context.Background(), 200)
+	if !errors.Is(err, ErrorInvalidParameter) {
+		t.Errorf("expected error opening a missing process, got %v", err)
+	}
+
+	f.AddProcess(200, "app.exe")
+	f.SetQuerySystemExtendedHandleInformationError(ErrHandleInformationTooLarge)
+	_, err = h.GetContainerIDByProcess(context.Background(), 200)
+	if !errors.Is(err, ErrHandleInformationTooLarge) {
+		t.Errorf("expected handle information error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.SetQuerySystemExtendedHandleInformationError(nil)
+	_, err = h.GetContainerIDByProcess(ctx, 200)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled error, got %v", err)
+	}
+	if n := f.OpenHandles(); n != 0 {
+		t.Errorf("%d handles left open", n)
+	}
+}
+
+func TestGetContainerIDByProcessSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	f := NewFakeAPI()
+	f.AddProcess(vmcomputePID, "vmcompute.exe")
+	f.AddProcess(200, "app.exe")
+	f.AddJob(vmcomputePID, 8, `\Container_`+containerID, 200)
+
+	_, err := newTestHelper(f).GetContainerIDByProcess(context.Background(), 200)
+	checkError(t, err, nil)
+
+	var lookup *tracetest.SpanStub
+	spans := exporter.GetSpans()
+	for i := range spans {
+		if spans[i].Name == "process.GetContainerIDByProcess" {
+			lookup = &spans[i]
+		}
+	}
+	if lookup == nil {
+		t.Fatalf("attestation span not exported, got %d spans", len(spans))
+	}
+
+	attrs := make(map[string]interface{})
+	for _, attr := range lookup.Attributes {
+		attrs[string(attr.Key)] = attr.Value.AsInterface()
+	}
+	expected := map[string]interface{}{
+		telemetry.PID:         int64(200),
+		telemetry.ContainerID: containerID,
+		"handle_count":        int64(1),
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("unexpected span attributes: got %v, want %v", attrs, expected)
+	}
+
+	// Child spans of the lookup steps share the trace of the lookup
+	for _, span := range spans {
+		if span.SpanContext.TraceID() != lookup.SpanContext.TraceID() {
+			t.Errorf("span %q is not part of the lookup trace", span.Name)
+		}
+	}
+}
+
+func TestSearchProcessByExeFile(t *testing.T) {
+	f := NewFakeAPI()
+	f.AddProcess(4, "System")
+	f.AddProcess(100, "vmcompute.exe")
+	f.AddProcess(200, "app.exe")
+	f.AddProcess(300, "vmcompute.exe")
+	h := newTestHelper(f).(*helper)
+
+	pIDs, err := h.searchProcessByExeFile("vmcompute.exe")
+	checkError(t, err, nil)
+	if expected := []uint32{100, 300}; !reflect.DeepEqual(pIDs, expected) {
+		t.Errorf("unexpected processes: got %v, want %v", pIDs, expected)
+	}
+
+	pIDs, err = h.searchProcessByExeFile("missing.exe")
+	checkError(t, err, nil)
+	if len(pIDs) != 0 {
+		t.Errorf("unexpected processes: %v", pIDs)
+	}
+	if n := f.OpenHandles(); n != 0 {
+		t.Errorf("%d handles left open", n)
+	}
+}
+
+func TestGetContainerJobName(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		typeName string
+		object   string
+		expName  string
+	}{
+		{name: "container job", typeName: "Job", object: `\Container_` + containerID, expName: `\Container_` + containerID},
+		{name: "other job", typeName: "Job", object: `\Sessions\1\BaseNamedObjects\job`},
+		{name: "unnamed job", typeName: "Job"},
+		{name: "prefix is case sensitive", typeName: "Job", object: `\container_` + containerID},
+		{name: "not a job", typeName: "Event", object: `\Container_` + containerID},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeAPI()
+			f.AddProcess(vmcomputePID, "vmcompute.exe")
+			f.AddHandle(vmcomputePID, 8, tt.typeName, tt.object)
+			h := newTestHelper(f).(*helper)
+
+			vmcompute, err := f.OpenProcess(ProcessDupHandle, false, vmcomputePID)
+			checkError(t, err, nil)
+			var dupHandle Handle
+			err = f.DuplicateHandle(vmcompute, 8, f.CurrentProcess(), &dupHandle, 0, true, DuplicateSameAccess)
+			checkError(t, err, nil)
+
+			name, err := h.getContainerJobName(dupHandle)
+			checkError(t, err, nil)
+			if name != tt.expName {
+				t.Errorf("unexpected job name: got %q, want %q", name, tt.expName)
+			}
+		})
+	}
+}
+
+func checkError(t *testing.T, err, expErr error) {
+	t.Helper()
+	switch {
+	case expErr == nil && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case expErr != nil && err == nil:
+		t.Fatalf("expected error %q", expErr)
+	case expErr != nil && !errors.Is(err, expErr) && err.Error() != expErr.Error():
+		t.Fatalf("unexpected error: got %q, want %q", err, expErr)
+	}
+}
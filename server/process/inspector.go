@@ -0,0 +1,107 @@
+package process
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Inspector collects the selectors of a process that runs on the host
+type Inspector interface {
+	Selectors(ctx context.Context, pID int32) ([]string, error)
+}
+
+// NewWindowsInspector creates an inspector that performs the Windows calls through the
+// provided API. When discoverSHA256 is set, the SHA-256 of the process executable is
+// added to the selectors.
+func NewWindowsInspector(log hclog.Logger, wapi API, discoverSHA256 bool) Inspector {
+	return &windowsInspector{
+		log:            log,
+		wapi:           wapi,
+		discoverSHA256: discoverSHA256,
+	}
+}
+
+type windowsInspector struct {
+	log            hclog.Logger
+	wapi           API
+	discoverSHA256 bool
+}
+
+// Selectors returns the user SID, enabled groups, executable path and
+// optionally the executable SHA-256 of the process
+func (i *windowsInspector) Selectors(ctx context.Context, pID int32) ([]string, error) {
+	_, span := telemetry.Tracer().Start(ctx, "process.windowsInspector.Selectors")
+	defer span.End()
+
+	hProcess, err := i.wapi.OpenProcess(ProcessQueryLimitedInformation, false, uint32(pID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open process: %w", err)
+	}
+	defer func() {
+		if err := i.wapi.CloseHandle(hProcess); err != nil {
+			i.log.Debug("Could not close process handle", telemetry.Error, err)
+		}
+	}()
+
+	userSID, err := i.wapi.GetProcessUserSID(hProcess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get process user: %w", err)
+	}
+
+	groups, err := i.wapi.GetProcessTokenGroups(hProcess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get process groups: %w", err)
+	}
+
+	path, err := i.wapi.QueryFullProcessImageName(hProcess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get process image name: %w", err)
+	}
+
+	selectors := []string{
+		fmt.Sprintf("windows:user_sid:%s", userSID),
+	}
+	for _, group := range groups {
+		// Only enabled groups grant access, deny-only groups can only deny it
+		if group.Attributes&SeGroupEnabled == 0 || group.Attributes&SeGroupUseForDenyOnly != 0 {
+			continue
+		}
+		selectors = append(selectors, fmt.Sprintf("windows:group_sid:%s", group.SID))
+		if group.Name != "" {
+			selectors = append(selectors, fmt.Sprintf("windows:group_name:%s", group.Name))
+		}
+	}
+	selectors = append(selectors, fmt.Sprintf("windows:path:%s", path))
+
+	if i.discoverSHA256 {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate executable SHA-256: %w", err)
+		}
+		selectors = append(selectors, fmt.Sprintf("windows:sha256:%s", sum))
+	}
+
+	return selectors, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of the file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
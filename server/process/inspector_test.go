@@ -0,0 +1,123 @@
+package process
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	testUserSID  = "S-1-5-21-1004336348-1177238915-682003330-1001"
+	testUsersSID = "S-1-5-32-545"
+	// testLogonSID is a logon session SID, it can not be resolved to an account
+	testLogonSID  = "S-1-5-5-0-123456"
+	testAdminsSID = "S-1-5-32-544"
+	testGuestsSID = "S-1-5-32-546"
+)
+
+func TestWindowsInspectorSelectors(t *testing.T) {
+	image := []byte("app")
+	imagePath := filepath.Join(t.TempDir(), "app.exe")
+	if err := os.WriteFile(imagePath, image, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(image)
+
+	groups := []TokenGroup{
+		{SID: testUsersSID, Name: `BUILTIN\Users`, Attributes: SeGroupEnabled},
+		{SID: testLogonSID, Attributes: SeGroupEnabled},
+		// e.g. the Administrators group of a filtered token
+		{SID: testAdminsSID, Name: `BUILTIN\Administrators`, Attributes: SeGroupUseForDenyOnly},
+		{SID: testGuestsSID, Name: `BUILTIN\Guests`},
+	}
+	defaultSelectors := []string{
+		"windows:user_sid:" + testUserSID,
+		"windows:group_sid:" + testUsersSID,
+		`windows:group_name:BUILTIN\Users`,
+		"windows:group_sid:" + testLogonSID,
+		"windows:path:" + imagePath,
+	}
+
+	for _, tt := range []struct {
+		name           string
+		setup          func(f *FakeAPI)
+		discoverSHA256 bool
+		expected       []string
+		expectErr      bool
+	}{
+		{
+			name:     "selectors",
+			expected: defaultSelectors,
+		},
+		{
+			name:           "sha256",
+			discoverSHA256: true,
+			expected:       append(append([]string{}, defaultSelectors...), "windows:sha256:"+hex.EncodeToString(sum[:])),
+		},
+		{
+			name: "enabled deny-only group",
+			setup: func(f *FakeAPI) {
+				f.SetProcessGroups(200, TokenGroup{SID: testAdminsSID, Name: `BUILTIN\Administrators`, Attributes: SeGroupEnabled | SeGroupUseForDenyOnly})
+			},
+			expected: []string{"windows:user_sid:" + testUserSID, "windows:path:" + imagePath},
+		},
+		{
+			name: "process can not be opened",
+			setup: func(f *FakeAPI) {
+				f.SetOpenProcessError(200, ErrorAccessDenied)
+			},
+			expectErr: true,
+		},
+		{
+			name: "token can not be read",
+			setup: func(f *FakeAPI) {
+				f.SetProcessTokenError(200, ErrorAccessDenied)
+			},
+			expectErr: true,
+		},
+		{
+			name: "image can not be hashed",
+			setup: func(f *FakeAPI) {
+				f.SetProcessImagePath(200, filepath.Join(t.TempDir(), "missing.exe"))
+			},
+			discoverSHA256: true,
+			expectErr:      true,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeAPI()
+			f.AddProcess(200, "app.exe")
+			f.SetProcessUser(200, testUserSID)
+			f.SetProcessGroups(200, groups...)
+			f.SetProcessImagePath(200, imagePath)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			inspector := NewWindowsInspector(hclog.NewNullLogger(), f, tt.discoverSHA256)
+
+			selectors, err := inspector.Selectors(context.Background(), 200)
+			if n := f.OpenHandles(); n != 0 {
+				t.Errorf("%d handles left open", n)
+			}
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(selectors, tt.expected) {
+				t.Errorf("unexpected selectors:\ngot  %v\nwant %v", selectors, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package process
+
+import (
+	"sync"
+)
+
+// jobIndex caches the container job handles owned by vmcompute processes,
+// so the system handle table is only scanned for vmcompute processes that
+// were not indexed before.
+type jobIndex struct {
+	mtx sync.Mutex
+	// jobs holds the container job handles by vmcompute process ID
+	jobs map[uint32][]indexedJob
+	// scannedAt is the system time the handles of each vmcompute process were scanned
+	scannedAt map[uint32]uint64
+}
+
+// indexedJob is a container job handle owned by a vmcompute process
+type indexedJob struct {
+	handle SystemHandleInformationExItem
+	name   string
+}
+
+func newJobIndex() *jobIndex {
+	return &jobIndex{
+		jobs:      make(map[uint32][]indexedJob),
+		scannedAt: make(map[uint32]uint64),
+	}
+}
+
+// sync drops the entries of vmcompute processes that are no longer running
+// (e.g. vmcompute was restarted) and returns the processes that are not indexed.
+func (i *jobIndex) sync(pIDs []uint32) []uint32 {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	running := make(map[uint32]bool, len(pIDs))
+	var missing []uint32
+	for _, pID := range pIDs {
+		running[pID] = true
+		if _, ok := i.jobs[pID]; !ok {
+			missing = append(missing, pID)
+		}
+	}
+
+	for pID := range i.jobs {
+		if !running[pID] {
+			delete(i.jobs, pID)
+			delete(i.scannedAt, pID)
+		}
+	}
+
+	return missing
+}
+
+// set replaces the indexed jobs of a vmcompute process, scanned at the given system time
+func (i *jobIndex) set(pID uint32, jobs []indexedJob, scannedAt uint64) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.jobs[pID] = jobs
+	i.scannedAt[pID] = scannedAt
+}
+
+// scannedBefore returns true when the handles of any vmcompute process were
+// scanned before the given system time
+func (i *jobIndex) scannedBefore(t uint64) bool {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	for _, scannedAt := range i.scannedAt {
+		if scannedAt < t {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops a job handle, it is called when the handle is no longer
+// valid (e.g. the container exited and vmcompute closed it)
+func (i *jobIndex) remove(job indexedJob) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	pID := uint32(job.handle.UniqueProcessID)
+	jobs := i.jobs[pID]
+	for idx, each := range jobs {
+		if each.handle.HandleValue == job.handle.HandleValue {
+			// Copy to not modify slices returned by list
+			updated := make([]indexedJob, 0, len(jobs)-1)
+			updated = append(updated, jobs[:idx]...)
+			i.jobs[pID] = append(updated, jobs[idx+1:]...)
+			return
+		}
+	}
+}
+
+// list returns all the indexed jobs
+func (i *jobIndex) list() []indexedJob {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	var jobs []indexedJob
+	for _, each := range i.jobs {
+		jobs = append(jobs, each...)
+	}
+	return jobs
+}
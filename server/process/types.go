@@ -0,0 +1,170 @@
+package process
+
+import (
+	"errors"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+// Windows definitions used by the helper. They mirror the values in
+// golang.org/x/sys/windows, so the helper can be built on any platform.
+const (
+	// Process access rights (https://docs.microsoft.com/en-us/windows/win32/procthread/process-security-and-access-rights)
+	ProcessDupHandle               uint32 = 0x0040
+	ProcessQueryLimitedInformation uint32 = 0x1000
+
+	// Includes all processes in the system in the snapshot. (https://docs.microsoft.com/en-us/windows/win32/api/tlhelp32/nf-tlhelp32-createtoolhelp32snapshot)
+	Th32csSnapProcess uint32 = 0x00000002
+
+	// DuplicateHandle options (https://docs.microsoft.com/en-us/windows/win32/api/handleapi/nf-handleapi-duplicatehandle)
+	DuplicateSameAccess uint32 = 0x00000002
+
+	maxPath = 260
+
+	// MaxHandleInformationSize is the maximum size of the buffer used to query the system handle table
+	MaxHandleInformationSize = 256 * 1024 * 1024
+)
+
+// ErrHandleInformationTooLarge is returned when the system handle table does not fit in MaxHandleInformationSize
+var ErrHandleInformationTooLarge = errors.New("system handle information exceeds the maximum buffer size")
+
+// System error codes (https://docs.microsoft.com/en-us/windows/win32/debug/system-error-codes--0-499-)
+const (
+	ErrorAccessDenied     syscall.Errno = 5
+	ErrorNoMoreFiles      syscall.Errno = 18
+	ErrorNotSupported     syscall.Errno = 50
+	ErrorInvalidParameter syscall.Errno = 87
+)
+
+// Token group attributes (https://docs.microsoft.com/en-us/windows/win32/api/winnt/ns-winnt-token_groups)
+const (
+	SeGroupEnabled        uint32 = 0x00000004
+	SeGroupUseForDenyOnly uint32 = 0x00000010
+)
+
+// Handle is a Windows object handle
+type Handle uintptr
+
+// ProcessEntry32 describes an entry from a list of the processes residing in the system address space
+// when a snapshot was taken (https://docs.microsoft.com/en-us/windows/win32/api/tlhelp32/ns-tlhelp32-processentry32)
+type ProcessEntry32 struct {
+	Size            uint32
+	Usage           uint32
+	ProcessID       uint32
+	DefaultHeapID   uintptr
+	ModuleID        uint32
+	Threads         uint32
+	ParentProcessID uint32
+	PriClassBase    int32
+	Flags           uint32
+	ExeFile         [maxPath]uint16
+}
+
+// Filetime is a 64-bit value representing the number of 100-nanosecond
+// intervals since January 1, 1601 (UTC)
+type Filetime struct {
+	LowDateTime  uint32
+	HighDateTime uint32
+}
+
+// Value returns the Filetime as a single 64-bit value
+func (ft Filetime) Value() uint64 {
+	return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+}
+
+// Time returns the Filetime as a time
+func (ft Filetime) Time() time.Time {
+	// Seconds between January 1, 1601 and January 1, 1970
+	const unixEpochSeconds = 11644473600
+	value := ft.Value()
+	return time.Unix(int64(value/10_000_000)-unixEpochSeconds, int64(value%10_000_000)*100)
+}
+
+// TokenGroup is a group in a process token
+type TokenGroup struct {
+	// SID is the string representation of the group SID
+	SID string
+	// Name is the account name of the group in the `domain\name` format,
+	// it is empty when the SID could not be resolved
+	Name string
+	// Attributes are the SE_GROUP_* attributes of the group
+	Attributes uint32
+}
+
+// System handle extended information item, returned by NtQuerySystemInformation (https://docs.microsoft.com/en-us/windows/win32/api/winternl/nf-winternl-ntquerysysteminformation)
+type SystemHandleInformationExItem struct {
+	Object                uintptr
+	UniqueProcessID       uintptr
+	HandleValue           uintptr
+	GrantedAccess         uint32
+	CreatorBackTraceIndex uint16
+	ObjectTypeIndex       uint16
+	HandleAttributes      uint32
+	Reserved              uint32
+}
+
+// API abstracts the Windows calls used by the helper
+type API interface {
+	// IsProcessInJob determines whether the process is running in the specified job.
+	IsProcessInJob(procHandle Handle, jobHandle Handle, result *bool) error
+
+	// GetObjectType gets the object type of the given handle
+	GetObjectType(handle Handle) (string, error)
+
+	// GetObjectName gets the object name of the given handle
+	GetObjectName(handle Handle) (string, error)
+
+	// QuerySystemExtendedHandleInformation retrieves Extended handle system information.
+	// It fails with ErrHandleInformationTooLarge when the handle table exceeds MaxHandleInformationSize.
+	QuerySystemExtendedHandleInformation() ([]SystemHandleInformationExItem, error)
+
+	// CurrentProcess returns the handle for the current process.
+	// It is a pseudo handle that does not need to be closed.
+	CurrentProcess() Handle
+
+	// CloseHandle closes an open object handle.
+	CloseHandle(h Handle) error
+
+	// OpenProcess returns an open handle
+	OpenProcess(desiredAccess uint32, inheritHandle bool, pID uint32) (Handle, error)
+
+	// DuplicateHandle duplicates an object handle.
+	DuplicateHandle(hSourceProcessHandle Handle, hSourceHandle Handle, hTargetProcessHandle Handle, lpTargetHandle *Handle, dwDesiredAccess uint32, bInheritHandle bool, dwOptions uint32) error
+
+	// CreateToolhelp32Snapshot takes a snapshot of the specified processes, as well as the heaps, modules, and threads used by these processes.
+	CreateToolhelp32Snapshot(flags uint32, pID uint32) (Handle, error)
+
+	// Process32First retrieves information about the first process encountered in a system snapshot.
+	Process32First(snapshot Handle, procEntry *ProcessEntry32) error
+
+	// Process32Next retrieves information about the next process recorded in a system snapshot.
+	Process32Next(snapshot Handle, procEntry *ProcessEntry32) error
+
+	// GetProcessTimes retrieves timing information for the specified process.
+	GetProcessTimes(process Handle, creationTime, exitTime, kernelTime, userTime *Filetime) error
+
+	// GetSystemTimeAsFileTime retrieves the current system date and time.
+	GetSystemTimeAsFileTime(time *Filetime)
+
+	// GetProcessUserSID retrieves the SID of the user of the process token.
+	GetProcessUserSID(process Handle) (string, error)
+
+	// QueryFullProcessImageName retrieves the full path of the executable image of the process.
+	QueryFullProcessImageName(process Handle) (string, error)
+
+	// GetProcessTokenGroups retrieves the groups of the process token.
+	GetProcessTokenGroups(process Handle) ([]TokenGroup, error)
+}
+
+// utf16ToString returns the UTF-8 encoding of the UTF-16 sequence s,
+// with a terminating NUL removed.
+func utf16ToString(s []uint16) string {
+	for i, v := range s {
+		if v == 0 {
+			s = s[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(s))
+}
@@ -0,0 +1,223 @@
+package process
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
+)
+
+// NewUnixInspector creates an inspector that reads the process information from
+// procfs and the user and group databases under the provided root directory
+// (usually "/"). When discoverSHA256 is set, the SHA-256 of the process binary is
+// added to the selectors.
+func NewUnixInspector(log hclog.Logger, rootDir string, discoverSHA256 bool) Inspector {
+	return &unixInspector{
+		log:            log,
+		rootDir:        rootDir,
+		discoverSHA256: discoverSHA256,
+	}
+}
+
+type unixInspector struct {
+	log            hclog.Logger
+	rootDir        string
+	discoverSHA256 bool
+}
+
+// processStatus holds the fields used from /proc/<pid>/status
+type processStatus struct {
+	uid    string
+	gid    string
+	groups []string
+}
+
+// Selectors returns the effective uid and gid, supplementary groups, binary
+// path and optionally the binary SHA-256 of the process
+func (i *unixInspector) Selectors(ctx context.Context, pID int32) ([]string, error) {
+	_, span := telemetry.Tracer().Start(ctx, "process.unixInspector.Selectors")
+	defer span.End()
+
+	procDir := filepath.Join(i.rootDir, "proc", strconv.Itoa(int(pID)))
+
+	status, err := readProcessStatus(filepath.Join(procDir, "status"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read process status: %w", err)
+	}
+
+	path, err := os.Readlink(filepath.Join(procDir, "exe"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read process binary path: %w", err)
+	}
+
+	users, err := readNames(filepath.Join(i.rootDir, "etc", "passwd"))
+	if err != nil {
+		i.log.Debug("Unable to read user database", telemetry.Error, err)
+	}
+	groups, err := readNames(filepath.Join(i.rootDir, "etc", "group"))
+	if err != nil {
+		i.log.Debug("Unable to read group database", telemetry.Error, err)
+	}
+
+	selectors := []string{
+		fmt.Sprintf("unix:uid:%s", status.uid),
+	}
+	if name, ok := users[status.uid]; ok {
+		selectors = append(selectors, fmt.Sprintf("unix:user:%s", name))
+	}
+	selectors = append(selectors, fmt.Sprintf("unix:gid:%s", status.gid))
+	if name, ok := groups[status.gid]; ok {
+		selectors = append(selectors, fmt.Sprintf("unix:group:%s", name))
+	}
+	for _, gid := range status.groups {
+		selectors = append(selectors, fmt.Sprintf("unix:supplementary_gid:%s", gid))
+		if name, ok := groups[gid]; ok {
+			selectors = append(selectors, fmt.Sprintf("unix:supplementary_group:%s", name))
+		}
+	}
+	selectors = append(selectors, fmt.Sprintf("unix:path:%s", path))
+
+	if i.discoverSHA256 {
+		// The exe link opens the binary the process runs, even when the path
+		// is in another mount namespace or the binary was replaced or deleted
+		sum, err := fileSHA256(filepath.Join(procDir, "exe"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate binary SHA-256: %w", err)
+		}
+		selectors = append(selectors, fmt.Sprintf("unix:sha256:%s", sum))
+	}
+
+	return selectors, nil
+}
+
+// readProcessStatus parses the Uid, Gid and Groups lines of /proc/<pid>/status,
+// Uid and Gid lines contain the real, effective, saved set and filesystem IDs.
+func readProcessStatus(path string) (*processStatus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	status := new(processStatus)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+
+		switch key {
+		case "Uid":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed Uid line: %q", value)
+			}
+			status.uid = fields[1]
+		case "Gid":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("malformed Gid line: %q", value)
+			}
+			status.gid = fields[1]
+		case "Groups":
+			status.groups = fields
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if status.uid == "" || status.gid == "" {
+		return nil, fmt.Errorf("uid or gid not found in %s", path)
+	}
+	return status, nil
+}
+
+// readNames parses a passwd or group database, and returns the names by ID.
+// Both formats have the name in the first field and the ID in the third one.
+func readNames(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		// Keep the first entry when an ID is repeated
+		if _, ok := names[fields[2]]; !ok {
+			names[fields[2]] = fields[0]
+		}
+	}
+	return names, scanner.Err()
+}
+
+// NewUnixAncestry creates an Ancestry that reads the parent processes from
+// procfs under the provided root directory (usually "/")
+func NewUnixAncestry(rootDir string) Ancestry {
+	return &unixAncestry{rootDir: rootDir}
+}
+
+type unixAncestry struct {
+	rootDir string
+}
+
+// Ancestors returns the IDs of the ancestors of the process, its parent first
+func (a *unixAncestry) Ancestors(ctx context.Context, pID int32) ([]int32, error) {
+	parentID, startTime, err := a.readStat(pID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read process stat: %w", err)
+	}
+
+	var ancestors []int32
+	visited := map[int32]bool{pID: true}
+	for parentID > 0 && !visited[parentID] {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		visited[parentID] = true
+
+		// The parent exited, or its ID was reused by a newer process
+		grandparentID, parentStartTime, err := a.readStat(parentID)
+		if err != nil || parentStartTime > startTime {
+			return ancestors, nil
+		}
+
+		ancestors = append(ancestors, parentID)
+		parentID = grandparentID
+		startTime = parentStartTime
+	}
+	return ancestors, nil
+}
+
+// readStat returns the parent ID and start time of the process
+func (a *unixAncestry) readStat(pID int32) (int32, uint64, error) {
+	fields, err := readProcessStat(filepath.Join(a.rootDir, "proc", strconv.Itoa(int(pID)), "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	parentID, err := strconv.ParseInt(fields[statParentPID], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed parent process ID %q: %w", fields[statParentPID], err)
+	}
+	startTime, err := strconv.ParseUint(fields[statStartTime], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed start time %q: %w", fields[statStartTime], err)
+	}
+	return int32(parentID), startTime, nil
+}
@@ -0,0 +1,254 @@
+//go:build !windows
+// +build !windows
+
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	testPasswd = `# comment
+root:x:0:0:root:/root:/bin/bash
+wservice:x:1000:1000::/home/wservice:/bin/sh
+duplicate:x:1000:1000::/home/duplicate:/bin/sh
+`
+	testGroup = `root:x:0:
+wservice:x:1000:
+docker:x:998:wservice
+`
+	testStatus = `Name:	wservice
+Pid:	4242
+Uid:	0	1000	1000	1000
+Gid:	0	1000	1000	1000
+Groups:	998 999
+`
+	// testBinarySHA256 is the SHA-256 of "binary"
+	testBinarySHA256 = "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd"
+)
+
+// writeRootDir creates a root directory with the provided files, and a
+// proc/4242/exe link to the binary. Like in procfs, the link target is a path
+// that may not exist in the root directory.
+func writeRootDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	rootDir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(rootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	binary := filepath.Join(t.TempDir(), "wservice")
+	if err := os.WriteFile(binary, []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	procDir := filepath.Join(rootDir, "proc", "4242")
+	if err := os.MkdirAll(procDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(binary, filepath.Join(procDir, "exe")); err != nil {
+		t.Fatal(err)
+	}
+	return rootDir
+}
+
+func TestUnixInspectorSelectors(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		files          map[string]string
+		discoverSHA256 bool
+		expected       []string
+		expectErr      bool
+	}{
+		{
+			name: "names",
+			files: map[string]string{
+				"proc/4242/status": testStatus,
+				"etc/passwd":       testPasswd,
+				"etc/group":        testGroup,
+			},
+			expected: []string{
+				"unix:uid:1000",
+				"unix:user:wservice",
+				"unix:gid:1000",
+				"unix:group:wservice",
+				"unix:supplementary_gid:998",
+				"unix:supplementary_group:docker",
+				"unix:supplementary_gid:999",
+			},
+		},
+		{
+			name: "no user and group databases",
+			files: map[string]string{
+				"proc/4242/status": testStatus,
+			},
+			expected: []string{
+				"unix:uid:1000",
+				"unix:gid:1000",
+				"unix:supplementary_gid:998",
+				"unix:supplementary_gid:999",
+			},
+		},
+		{
+			name: "sha256",
+			files: map[string]string{
+				"proc/4242/status": "Uid:\t0\t0\t0\t0\nGid:\t0\t0\t0\t0\nGroups:\n",
+				"etc/passwd":       testPasswd,
+			},
+			discoverSHA256: true,
+			expected: []string{
+				"unix:uid:0",
+				"unix:user:root",
+				"unix:gid:0",
+				"unix:sha256:" + testBinarySHA256,
+			},
+		},
+		{
+			name: "malformed status",
+			files: map[string]string{
+				"proc/4242/status": "Uid:\t0\n",
+			},
+			expectErr: true,
+		},
+		{
+			name: "missing uid",
+			files: map[string]string{
+				"proc/4242/status": "Gid:\t0\t0\t0\t0\n",
+			},
+			expectErr: true,
+		},
+		{
+			name:      "missing process",
+			expectErr: true,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rootDir := writeRootDir(t, tt.files)
+			inspector := NewUnixInspector(hclog.NewNullLogger(), rootDir, tt.discoverSHA256)
+
+			selectors, err := inspector.Selectors(context.Background(), 4242)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The path is the target of the exe link
+			binary, err := os.Readlink(filepath.Join(rootDir, "proc", "4242", "exe"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append([]string{}, tt.expected...)
+			pathSelector := "unix:path:" + binary
+			if tt.discoverSHA256 {
+				expected = append(expected[:len(expected)-1], pathSelector, expected[len(expected)-1])
+			} else {
+				expected = append(expected, pathSelector)
+			}
+			if !reflect.DeepEqual(selectors, expected) {
+				t.Errorf("unexpected selectors:\ngot  %v\nwant %v", selectors, expected)
+			}
+		})
+	}
+}
+
+func TestUnixInspectorHashesRunningBinary(t *testing.T) {
+	rootDir := writeRootDir(t, map[string]string{
+		"proc/4242/status": testStatus,
+	})
+	binary, err := os.Readlink(filepath.Join(rootDir, "proc", "4242", "exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file at the link path under the root directory, e.g. a binary of
+	// another mount namespace, must not be hashed
+	decoy := filepath.Join(rootDir, binary)
+	if err := os.MkdirAll(filepath.Dir(decoy), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(decoy, []byte("decoy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	selectors, err := NewUnixInspector(hclog.NewNullLogger(), rootDir, true).Selectors(context.Background(), 4242)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if last := selectors[len(selectors)-1]; last != "unix:sha256:"+testBinarySHA256 {
+		t.Errorf("unexpected SHA-256 selector %q", last)
+	}
+}
+
+func TestUnixAncestryAncestors(t *testing.T) {
+	rootDir := t.TempDir()
+	// stat is the /proc/<pid>/stat of a process with the given parent and start time
+	for pID, stat := range map[int]struct {
+		parentID  int
+		startTime int
+	}{
+		1:    {parentID: 0, startTime: 1},
+		100:  {parentID: 1, startTime: 100},
+		200:  {parentID: 100, startTime: 200},
+		4242: {parentID: 200, startTime: 300},
+		// The parent of 600 exited, and its ID was reused by a newer process
+		500: {parentID: 1, startTime: 700},
+		600: {parentID: 500, startTime: 600},
+		// The parent of 800 exited
+		800: {parentID: 700, startTime: 800},
+	} {
+		procDir := filepath.Join(rootDir, "proc", strconv.Itoa(pID))
+		if err := os.MkdirAll(procDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		content := fmt.Sprintf("%d (my (app) x) S %d 1 1 0 -1 4194560 1 0 0 0 0 0 0 0 20 0 1 0 %d 1000 100 0\n", pID, stat.parentID, stat.startTime)
+		if err := os.WriteFile(filepath.Join(procDir, "stat"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := NewUnixAncestry(rootDir)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name      string
+		pID       int32
+		ancestors []int32
+	}{
+		{name: "ancestors", pID: 4242, ancestors: []int32{200, 100, 1}},
+		{name: "init", pID: 1},
+		{name: "reused parent ID", pID: 600},
+		{name: "exited parent", pID: 800},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ancestors, err := a.Ancestors(ctx, tt.pID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ancestors, tt.ancestors) {
+				t.Errorf("unexpected ancestors: got %v, want %v", ancestors, tt.ancestors)
+			}
+		})
+	}
+
+	if _, err := a.Ancestors(ctx, 999); err == nil {
+		t.Error("expected error for a missing process")
+	}
+}
@@ -6,8 +6,11 @@ package process
 import (
 	"reflect"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/MarcosDY/npipeSample/server/telemetry"
+	"github.com/hashicorp/go-hclog"
 	"golang.org/x/sys/windows"
 )
 
@@ -28,51 +31,39 @@ const (
 	// ObjectInformationClass values used to call NtQueryObject (https://docs.microsoft.com/en-us/windows/win32/api/winternl/nf-winternl-ntqueryobject)
 	ObjectNameInformationClass = 0x1
 	ObjectTypeInformationClass = 0x2
-
-	// Includes all processes in the system in the snapshot. (https://docs.microsoft.com/en-us/windows/win32/api/tlhelp32/nf-tlhelp32-createtoolhelp32snapshot)
-	Th32csSnapProcess uint32 = 0x00000002
 )
 
-type API interface {
-	// IsProcessInJob determines whether the process is running in the specified job.
-	IsProcessInJob(procHandle windows.Handle, jobHandle windows.Handle, result *bool) error
-
-	// GetObjectType gets the object type of the given handle
-	GetObjectType(handle windows.Handle) (string, error)
-
-	// GetObjectName gets the object name of the given handle
-	GetObjectName(handle windows.Handle) (string, error)
-
-	// QuerySystemExtendedHandleInformation retrieves Extended handle system information.
-	QuerySystemExtendedHandleInformation() ([]SystemHandleInformationExItem, error)
-
-	// CurrentProcess returns the handle for the current process.
-	// It is a pseudo handle that does not need to be closed.
-	CurrentProcess() windows.Handle
-
-	// CloseHandle closes an open object handle.
-	CloseHandle(h windows.Handle) error
-
-	// OpenProcess returns an open handle
-	OpenProcess(desiredAccess uint32, inheritHandle bool, pID uint32) (windows.Handle, error)
+// CreateHelper creates a helper that uses the Windows API
+func CreateHelper(log hclog.Logger, metrics *telemetry.Metrics, ancestryDepth int) Helper {
+	return NewHelper(log, metrics, &api{}, ancestryDepth)
+}
 
-	// DuplicateHandle duplicates an object handle.
-	DuplicateHandle(hSourceProcessHandle windows.Handle, hSourceHandle windows.Handle, hTargetProcessHandle windows.Handle, lpTargetHandle *windows.Handle, dwDesiredAccess uint32, bInheritHandle bool, dwOptions uint32) error
+// CreateCachedHelper creates a helper that uses the Windows API, with a
+// cache of at most size processes in front of it
+func CreateCachedHelper(log hclog.Logger, metrics *telemetry.Metrics, size int, ancestryDepth int) *CachedHelper {
+	wapi := &api{}
+	return NewCachedHelper(log, metrics, wapi, NewHelper(log, metrics, wapi, ancestryDepth), size)
+}
 
-	// CreateToolhelp32Snapshot takes a snapshot of the specified processes, as well as the heaps, modules, and threads used by these processes.
-	CreateToolhelp32Snapshot(flags uint32, pID uint32) (windows.Handle, error)
+// CreateWindowsAncestry creates an Ancestry that uses the Windows API
+func CreateWindowsAncestry(log hclog.Logger) Ancestry {
+	return NewWindowsAncestry(log, &api{})
+}
 
-	// Process32First retrieves information about the first process encountered in a system snapshot.
-	Process32First(snapshot windows.Handle, procEntry *windows.ProcessEntry32) error
+// CreateWindowsInspector creates an inspector that uses the Windows API
+func CreateWindowsInspector(log hclog.Logger, discoverSHA256 bool) Inspector {
+	return NewWindowsInspector(log, &api{}, discoverSHA256)
+}
 
-	// Process32Next retrieves information about the next process recorded in a system snapshot.
-	Process32Next(snapshot windows.Handle, procEntry *windows.ProcessEntry32) error
+// OpenCaller tracks the process of a Workload API caller using the Windows API
+func OpenCaller(pID int32, connectedAt time.Time) (Caller, error) {
+	return NewWindowsCaller(&api{}, pID, connectedAt)
 }
 
 type api struct {
 }
 
-func (a *api) IsProcessInJob(procHandle windows.Handle, jobHandle windows.Handle, result *bool) error {
+func (a *api) IsProcessInJob(procHandle Handle, jobHandle Handle, result *bool) error {
 	if procIsProcessInJobErr != nil {
 		return procIsProcessInJobErr
 	}
@@ -87,7 +78,7 @@ func (a *api) IsProcessInJob(procHandle windows.Handle, jobHandle windows.Handle
 }
 
 // GetObjectType gets the object type of the given handle
-func (a *api) GetObjectType(handle windows.Handle) (string, error) {
+func (a *api) GetObjectType(handle Handle) (string, error) {
 	buffer := make([]byte, 1024*10)
 	length := uint32(0)
 
@@ -101,7 +92,7 @@ func (a *api) GetObjectType(handle windows.Handle) (string, error) {
 }
 
 // GetObjectName gets the object name of the given handle
-func (a *api) GetObjectName(handle windows.Handle) (string, error) {
+func (a *api) GetObjectName(handle Handle) (string, error) {
 	buffer := make([]byte, 1024*2)
 	var length uint32
 
@@ -130,11 +121,15 @@ func (a *api) QuerySystemExtendedHandleInformation() ([]SystemHandleInformationE
 		if status == windows.STATUS_BUFFER_OVERFLOW ||
 			status == windows.STATUS_BUFFER_TOO_SMALL ||
 			status == windows.STATUS_INFO_LENGTH_MISMATCH {
-			if int(retLen) <= cap(buffer) {
-				(*reflect.SliceHeader)(unsafe.Pointer(&buffer)).Len = int(retLen)
-			} else {
-				buffer = make([]byte, int(retLen))
+			// Always grow the buffer, handles may be created between calls
+			size := int(retLen)
+			if size <= len(buffer) {
+				size = len(buffer) * 2
+			}
+			if size > MaxHandleInformationSize {
+				return nil, ErrHandleInformationTooLarge
 			}
+			buffer = make([]byte, size)
 			continue
 		} else {
 			// if no error
@@ -156,46 +151,107 @@ func (a *api) QuerySystemExtendedHandleInformation() ([]SystemHandleInformationE
 	return nil, status
 }
 
-func (a *api) OpenProcess(desiredAccess uint32, inheritHandle bool, pID uint32) (windows.Handle, error) {
-	return windows.OpenProcess(desiredAccess, inheritHandle, pID)
+func (a *api) OpenProcess(desiredAccess uint32, inheritHandle bool, pID uint32) (Handle, error) {
+	h, err := windows.OpenProcess(desiredAccess, inheritHandle, pID)
+	return Handle(h), err
 }
 
-func (a *api) CloseHandle(h windows.Handle) error {
-	return windows.CloseHandle(h)
+func (a *api) CloseHandle(h Handle) error {
+	return windows.CloseHandle(windows.Handle(h))
 }
 
 // CurrentProcess returns the handle for the current process.
 // It is a pseudo handle that does not need to be closed.
-func (a *api) CurrentProcess() windows.Handle {
-	return windows.CurrentProcess()
+func (a *api) CurrentProcess() Handle {
+	return Handle(windows.CurrentProcess())
+}
+
+func (a *api) DuplicateHandle(hSourceProcessHandle Handle, hSourceHandle Handle, hTargetProcessHandle Handle, lpTargetHandle *Handle, dwDesiredAccess uint32, bInheritHandle bool, dwOptions uint32) error {
+	return windows.DuplicateHandle(windows.Handle(hSourceProcessHandle), windows.Handle(hSourceHandle), windows.Handle(hTargetProcessHandle), (*windows.Handle)(lpTargetHandle), dwDesiredAccess, bInheritHandle, dwOptions)
+}
+
+func (a *api) CreateToolhelp32Snapshot(flags uint32, pID uint32) (Handle, error) {
+	h, err := windows.CreateToolhelp32Snapshot(flags, pID)
+	return Handle(h), err
+}
+
+// Process32First retrieves information about the first process encountered in a system snapshot.
+// ProcessEntry32 has the same layout as windows.ProcessEntry32.
+func (a *api) Process32First(snapshot Handle, procEntry *ProcessEntry32) error {
+	return windows.Process32First(windows.Handle(snapshot), (*windows.ProcessEntry32)(unsafe.Pointer(procEntry)))
 }
 
-func (a *api) DuplicateHandle(hSourceProcessHandle windows.Handle, hSourceHandle windows.Handle, hTargetProcessHandle windows.Handle, lpTargetHandle *windows.Handle, dwDesiredAccess uint32, bInheritHandle bool, dwOptions uint32) error {
-	return windows.DuplicateHandle(hSourceProcessHandle, hSourceHandle, hTargetProcessHandle, lpTargetHandle, dwDesiredAccess, bInheritHandle, dwOptions)
+// Process32Next retrieves information about the next process recorded in a system snapshot.
+// ProcessEntry32 has the same layout as windows.ProcessEntry32.
+func (a *api) Process32Next(snapshot Handle, procEntry *ProcessEntry32) error {
+	return windows.Process32Next(windows.Handle(snapshot), (*windows.ProcessEntry32)(unsafe.Pointer(procEntry)))
 }
 
-func (a *api) CreateToolhelp32Snapshot(flags uint32, pID uint32) (windows.Handle, error) {
-	return windows.CreateToolhelp32Snapshot(flags, pID)
+// GetProcessTimes retrieves timing information for the specified process.
+// Filetime has the same layout as windows.Filetime.
+func (a *api) GetProcessTimes(process Handle, creationTime, exitTime, kernelTime, userTime *Filetime) error {
+	return windows.GetProcessTimes(windows.Handle(process),
+		(*windows.Filetime)(unsafe.Pointer(creationTime)),
+		(*windows.Filetime)(unsafe.Pointer(exitTime)),
+		(*windows.Filetime)(unsafe.Pointer(kernelTime)),
+		(*windows.Filetime)(unsafe.Pointer(userTime)))
 }
 
-func (a *api) Process32First(snapshot windows.Handle, procEntry *windows.ProcessEntry32) error {
-	return windows.Process32First(snapshot, procEntry)
+// GetSystemTimeAsFileTime retrieves the current system date and time.
+// Filetime has the same layout as windows.Filetime.
+func (a *api) GetSystemTimeAsFileTime(time *Filetime) {
+	windows.GetSystemTimeAsFileTime((*windows.Filetime)(unsafe.Pointer(time)))
 }
 
-func (a *api) Process32Next(snapshot windows.Handle, procEntry *windows.ProcessEntry32) error {
-	return windows.Process32Next(snapshot, procEntry)
+func (a *api) GetProcessUserSID(process Handle) (string, error) {
+	var token windows.Token
+	if err := windows.OpenProcessToken(windows.Handle(process), windows.TOKEN_QUERY, &token); err != nil {
+		return "", err
+	}
+	defer token.Close()
+
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	return tokenUser.User.Sid.String(), nil
 }
 
-// System handle extended information item, returned by NtQuerySystemInformation (https://docs.microsoft.com/en-us/windows/win32/api/winternl/nf-winternl-ntquerysysteminformation)
-type SystemHandleInformationExItem struct {
-	Object                uintptr
-	UniqueProcessID       uintptr
-	HandleValue           uintptr
-	GrantedAccess         uint32
-	CreatorBackTraceIndex uint16
-	ObjectTypeIndex       uint16
-	HandleAttributes      uint32
-	Reserved              uint32
+func (a *api) GetProcessTokenGroups(process Handle) ([]TokenGroup, error) {
+	var token windows.Token
+	if err := windows.OpenProcessToken(windows.Handle(process), windows.TOKEN_QUERY, &token); err != nil {
+		return nil, err
+	}
+	defer token.Close()
+
+	tokenGroups, err := token.GetTokenGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []TokenGroup
+	for _, group := range tokenGroups.AllGroups() {
+		var name string
+		// Groups like logon SIDs can not be resolved to an account
+		if account, domain, _, err := group.Sid.LookupAccount(""); err == nil {
+			name = domain + `\` + account
+		}
+		groups = append(groups, TokenGroup{
+			SID:        group.Sid.String(),
+			Name:       name,
+			Attributes: group.Attributes,
+		})
+	}
+	return groups, nil
+}
+
+func (a *api) QueryFullProcessImageName(process Handle) (string, error) {
+	buffer := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buffer))
+	if err := windows.QueryFullProcessImageName(windows.Handle(process), 0, &buffer[0], &size); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buffer[:size]), nil
 }
 
 // System extended handle information summary, returned by NtQuerySystemInformation (https://docs.microsoft.com/en-us/windows/win32/api/winternl/nf-winternl-ntquerysysteminformation)
@@ -237,7 +293,7 @@ func (u UnicodeString) String() string {
 	return windows.UTF16ToString(data)
 }
 
-func ntQueryObject(handle windows.Handle, objectInformationClass uint32, objectInformation *byte, objectInformationLength uint32, returnLength *uint32) (ntStatus windows.NTStatus) {
+func ntQueryObject(handle Handle, objectInformationClass uint32, objectInformation *byte, objectInformationLength uint32, returnLength *uint32) (ntStatus windows.NTStatus) {
 	if procNtQueryObjectErr != nil {
 		return windows.STATUS_PROCEDURE_NOT_FOUND
 	}
@@ -0,0 +1,207 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "npipe"
+
+// Metrics collects the server metrics and exposes them in Prometheus format.
+// A nil *Metrics is valid and discards all observations.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	rpcRequests      *prometheus.CounterVec
+	rpcDuration      *prometheus.HistogramVec
+	attestDuration   *prometheus.HistogramVec
+	lookupDuration   prometheus.Histogram
+	lookupHandles    prometheus.Histogram
+	lookupVmcompute  prometheus.Histogram
+	resolverLookups  *prometheus.CounterVec
+	kubeletRequests  *prometheus.CounterVec
+	kubeletDuration  prometheus.Histogram
+	cacheLookupCount *prometheus.CounterVec
+}
+
+// NewMetrics creates a Metrics with its own registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "workload_api",
+			Name:      "requests_total",
+			Help:      "Workload API requests by method and gRPC code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "workload_api",
+			Name:      "request_duration_seconds",
+			Help:      "Workload API unary request latency by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		attestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "workload_api",
+			Name:      "attestation_duration_seconds",
+			Help:      "Time spent attesting a Workload API caller by gRPC code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"code"}),
+		lookupDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "container_lookup",
+			Name:      "duration_seconds",
+			Help:      "Time spent resolving the container of a process.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		lookupHandles: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "container_lookup",
+			Name:      "handles_scanned",
+			Help:      "System handles scanned to resolve the container of a process.",
+			Buckets:   prometheus.ExponentialBuckets(1000, 4, 8),
+		}),
+		lookupVmcompute: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "container_lookup",
+			Name:      "vmcompute_processes",
+			Help:      "vmcompute.exe processes found while resolving the container of a process.",
+			Buckets:   prometheus.LinearBuckets(0, 1, 5),
+		}),
+		resolverLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "container_lookup",
+			Name:      "resolver_lookups_total",
+			Help:      "Container lookups of a resolver chain by resolver and result (container, host, indeterminate, error or mismatch).",
+		}, []string{"resolver", "result"}),
+		kubeletRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "kubelet",
+			Name:      "pods_requests_total",
+			Help:      "Kubelet /pods requests by HTTP status.",
+		}, []string{"status"}),
+		kubeletDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "kubelet",
+			Name:      "pods_request_duration_seconds",
+			Help:      "Kubelet /pods request latency.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		cacheLookupCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "lookups_total",
+			Help:      "Cache lookups by cache name and result (hit or miss).",
+		}, []string{"cache", "result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.rpcRequests,
+		m.rpcDuration,
+		m.attestDuration,
+		m.lookupDuration,
+		m.lookupHandles,
+		m.lookupVmcompute,
+		m.resolverLookups,
+		m.kubeletRequests,
+		m.kubeletDuration,
+		m.cacheLookupCount,
+	)
+
+	return m
+}
+
+// Handler returns the HTTP handler that serves the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// StreamServerInterceptor records the count of streaming RPCs by code. Streams
+// may stay open while the identity is valid, so their latency is not recorded,
+// see ObserveAttestation.
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		if m != nil {
+			m.rpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		}
+		return err
+	}
+}
+
+// UnaryServerInterceptor records count and latency of unary RPCs by code
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observeRPC(info.FullMethod, err, time.Since(start))
+		return resp, err
+	}
+}
+
+func (m *Metrics) observeRPC(method string, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	m.rpcDuration.WithLabelValues(method).Observe(d.Seconds())
+}
+
+// ObserveAttestation records the attestation of a Workload API caller
+func (m *Metrics) ObserveAttestation(err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.attestDuration.WithLabelValues(status.Code(err).String()).Observe(d.Seconds())
+}
+
+// ObserveContainerLookup records a process to container lookup
+func (m *Metrics) ObserveContainerLookup(d time.Duration, handles, vmcomputeProcesses int) {
+	if m == nil {
+		return
+	}
+	m.lookupDuration.Observe(d.Seconds())
+	m.lookupHandles.Observe(float64(handles))
+	m.lookupVmcompute.Observe(float64(vmcomputeProcesses))
+}
+
+// IncrResolverLookup records the result of a container lookup by one of the
+// resolvers of a chain
+func (m *Metrics) IncrResolverLookup(resolver, result string) {
+	if m == nil {
+		return
+	}
+	m.resolverLookups.WithLabelValues(resolver, result).Inc()
+}
+
+// ObserveKubeletRequest records a kubelet /pods request, status is the
+// HTTP status code or "error" when the request could not be performed.
+func (m *Metrics) ObserveKubeletRequest(status string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.kubeletRequests.WithLabelValues(status).Inc()
+	m.kubeletDuration.Observe(d.Seconds())
+}
+
+// IncrCacheLookup records a cache hit or miss for the named cache
+func (m *Metrics) IncrCacheLookup(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookupCount.WithLabelValues(cache, result).Inc()
+}
@@ -0,0 +1,55 @@
+package telemetry
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStreamServerInterceptor(t *testing.T) {
+	m := NewMetrics()
+	info := &grpc.StreamServerInfo{FullMethod: "/SpiffeWorkloadAPI/FetchX509SVID"}
+
+	// The stream stays open until the identity is revoked
+	err := m.StreamServerInterceptor()(nil, nil, info, func(interface{}, grpc.ServerStream) error {
+		m.ObserveAttestation(nil, 10*time.Millisecond)
+		return status.Error(codes.PermissionDenied, "container stopped")
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `
+# HELP npipe_workload_api_requests_total Workload API requests by method and gRPC code.
+# TYPE npipe_workload_api_requests_total counter
+npipe_workload_api_requests_total{code="PermissionDenied",method="/SpiffeWorkloadAPI/FetchX509SVID"} 1
+`
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(expected), "npipe_workload_api_requests_total"); err != nil {
+		t.Error(err)
+	}
+	// Only the attestation latency is recorded, not the stream lifetime
+	if n := testutil.CollectAndCount(m.rpcDuration); n != 0 {
+		t.Errorf("unexpected stream latency observations: %d", n)
+	}
+	if n := testutil.CollectAndCount(m.attestDuration); n != 1 {
+		t.Errorf("unexpected attestation latency series: %d", n)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObserveAttestation(nil, time.Second)
+	info := &grpc.StreamServerInfo{FullMethod: "/SpiffeWorkloadAPI/FetchX509SVID"}
+	if err := m.StreamServerInterceptor()(nil, nil, info, func(interface{}, grpc.ServerStream) error { return nil }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, _ = m.UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+		return nil, nil
+	})
+}
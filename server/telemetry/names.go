@@ -0,0 +1,59 @@
+package telemetry
+
+// Log field names used across the server, keep them consistent to
+// simplify filtering structured logs.
+const (
+	// Error the error returned by a failed call
+	Error = "error"
+
+	// PID the process ID of the workload
+	PID = "pid"
+
+	// AncestorPID the process ID of an ancestor of the workload
+	AncestorPID = "ancestor_pid"
+
+	// Depth the number of levels walked up a process tree
+	Depth = "depth"
+
+	// ContainerID the ID of the container that runs the workload
+	ContainerID = "container_id"
+
+	// ContainerRuntime the runtime scheme reported for a container
+	ContainerRuntime = "container_runtime"
+
+	// Resolver the container lookup method that resolved a process
+	Resolver = "resolver"
+
+	// Location where a process runs (host or container)
+	Location = "location"
+
+	// JobName the name of a job object
+	JobName = "job_name"
+
+	// PodUID the UID of a pod
+	PodUID = "pod_uid"
+
+	// PodName the name of a pod
+	PodName = "pod_name"
+
+	// Selector a selector value derived from workload attributes
+	Selector = "selector"
+
+	// Count the number of items in a collection
+	Count = "count"
+
+	// Policy the name of the policy applied to a workload
+	Policy = "policy"
+
+	// Check the name of a health check
+	Check = "check"
+
+	// Address the address a listener is bound to
+	Address = "address"
+
+	// ImagePath the full path of the executable image of a process
+	ImagePath = "image_path"
+
+	// UserSID the SID of the user a process runs as
+	UserSID = "user_sid"
+)
@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/MarcosDY/npipeSample/server"
+	serviceName = "npipe-server"
+
+	// TraceExporterNone disables tracing
+	TraceExporterNone = ""
+
+	// TraceExporterOTLP exports spans to an OTLP gRPC collector
+	TraceExporterOTLP = "otlp"
+
+	// TraceExporterStdout writes spans to stdout, useful for tests
+	TraceExporterStdout = "stdout"
+)
+
+// Span attribute keys used across attestation steps
+var (
+	AttrPID         = attribute.Key(PID)
+	AttrContainerID = attribute.Key(ContainerID)
+	AttrPodUID      = attribute.Key(PodUID)
+	AttrResolver    = attribute.Key(Resolver)
+	AttrHandleCount = attribute.Key("handle_count")
+)
+
+// Tracer returns the tracer used to instrument the server. Spans are
+// discarded until a tracer provider is installed with SetupTracing.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// SetupTracing installs a global tracer provider that exports spans with the
+// given exporter. The returned function flushes and stops the provider.
+func SetupTracing(ctx context.Context, exporter, endpoint string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case TraceExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TraceExporterOTLP:
+		spanExporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+	case TraceExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
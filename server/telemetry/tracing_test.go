@@ -0,0 +1,105 @@
+package telemetry
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeCollector is an OTLP gRPC trace receiver that keeps the exported spans
+type fakeCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mtx      sync.Mutex
+	services []string
+	spans    []*tracepb.Span
+}
+
+func (c *fakeCollector) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, resourceSpans := range req.ResourceSpans {
+		for _, attr := range resourceSpans.Resource.GetAttributes() {
+			if attr.Key == "service.name" {
+				c.services = append(c.services, attr.Value.GetStringValue())
+			}
+		}
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func TestSetupTracingOTLP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := new(fakeCollector)
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, collector)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	ctx := context.Background()
+	shutdown, err := SetupTracing(ctx, TraceExporterOTLP, lis.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	_, span := Tracer().Start(ctx, "FetchX509SVID")
+	span.SetAttributes(AttrPID.Int64(4242), AttrContainerID.String("a1b2c3d4e5f6"))
+	span.End()
+
+	// Shutting down flushes the batched spans
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down tracing: %v", err)
+	}
+
+	collector.mtx.Lock()
+	defer collector.mtx.Unlock()
+	if len(collector.spans) != 1 {
+		t.Fatalf("expected 1 exported span, got %d", len(collector.spans))
+	}
+	if len(collector.services) != 1 || collector.services[0] != serviceName {
+		t.Errorf("unexpected service names: %v", collector.services)
+	}
+
+	exported := collector.spans[0]
+	if exported.Name != "FetchX509SVID" {
+		t.Errorf("unexpected span name %q", exported.Name)
+	}
+	found := make(map[string]bool)
+	for _, attr := range exported.Attributes {
+		found[attr.Key] = true
+		switch attr.Key {
+		case PID:
+			if attr.Value.GetIntValue() != 4242 {
+				t.Errorf("unexpected %s attribute: %v", PID, attr.Value)
+			}
+		case ContainerID:
+			if attr.Value.GetStringValue() != "a1b2c3d4e5f6" {
+				t.Errorf("unexpected %s attribute: %v", ContainerID, attr.Value)
+			}
+		}
+	}
+	for _, key := range []string{PID, ContainerID} {
+		if !found[key] {
+			t.Errorf("missing %s attribute", key)
+		}
+	}
+}
+
+func TestSetupTracingUnsupportedExporter(t *testing.T) {
+	if _, err := SetupTracing(context.Background(), "zipkin", ""); err == nil {
+		t.Fatal("expected error for an unsupported exporter")
+	}
+}